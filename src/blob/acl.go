@@ -0,0 +1,17 @@
+package blob
+
+// ACL grants principals other than the owner access to a blob. Principals
+// are token subjects, or group names prefixed with "group:".
+type ACL struct {
+	Read   []string `json:"read,omitempty"`   // Principals that may read a private blob
+	Delete []string `json:"delete,omitempty"` // Principals that may delete the blob
+}
+
+// SetAccess changes the visibility and ACL of the blob. A nil acl removes
+// the ACL.
+func (b *Blob) SetAccess(visibility string, acl *ACL) error {
+	return b.update(func(fresh *Blob) {
+		fresh.Visibility = visibility
+		fresh.ACL = acl
+	})
+}
@@ -0,0 +1,33 @@
+package blob
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetAccess(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	b := store.New()
+	b.Name = "owned.txt"
+	b.Owner = "alice"
+	if err := b.WriteFrom(strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	acl := &ACL{Read: []string{"bob", "group:staff"}, Delete: []string{"carol"}}
+	if err := b.SetAccess(Private, acl); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Private() || got.Owner != "alice" || got.ACL == nil || len(got.ACL.Read) != 2 || got.ACL.Delete[0] != "carol" {
+		t.Fatalf("expected access to be stored got: %+v", got)
+	}
+	if err := got.SetAccess(Public, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.Get(b.ID); got.Private() || got.ACL != nil || got.Name != "owned.txt" {
+		t.Fatalf("expected ACL to be removed and other metadata kept got: %+v", got)
+	}
+}
@@ -0,0 +1,67 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	"uuid"
+)
+
+// ErrNotFound is returned by backends when no data or metadata exists for
+// the requested blob.
+var ErrNotFound = errors.New("blob not found")
+
+// File is the interface to blob data returned by a Backend. It must support
+// seeking so that it can be served with http.ServeContent.
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Backend is the interface to the underlying storage of blob data and
+// metadata. Blob data and metadata are addressed by the blob ID alone.
+type Backend interface {
+	// Put stores the data read from src as the blob data for id and
+	// returns the number of bytes written.
+	Put(id uuid.UUID, src io.Reader) (int64, error)
+	// Open returns a File for reading the blob data.
+	// Users must close the file.
+	Open(id uuid.UUID) (File, error)
+	// Stat returns the size of the blob data in bytes.
+	Stat(id uuid.UUID) (int64, error)
+	// Delete removes both the blob data and metadata. Data without
+	// metadata is removed too, but ErrNotFound is returned if there
+	// was no metadata.
+	Delete(id uuid.UUID) error
+	// ReadMeta returns the raw metadata stored for the blob.
+	ReadMeta(id uuid.UUID) ([]byte, error)
+	// WriteMeta stores the raw metadata for the blob.
+	WriteMeta(id uuid.UUID, data []byte) error
+}
+
+// pather is implemented by backends that keep blob data on the local
+// filesystem.
+type pather interface {
+	Path(id uuid.UUID) (string, error)
+}
+
+// Walker is implemented by backends that can enumerate the blobs they store.
+type Walker interface {
+	// Walk calls fn with the ID of every blob that has metadata.
+	// Walking stops at the first error returned by fn.
+	Walk(fn func(id uuid.UUID) error) error
+}
+
+// VariantBackend is implemented by backends that can cache variants of blob
+// data, such as resized images. Variants are removed along with the blob.
+type VariantBackend interface {
+	// PutVariant stores the data read from src as the variant called
+	// name of the blob data for id.
+	PutVariant(id uuid.UUID, name string, src io.Reader) error
+	// OpenVariant returns a File for reading the variant called name,
+	// or ErrNotFound if it has not been stored.
+	OpenVariant(id uuid.UUID, name string) (File, error)
+	// DeleteVariant removes the variant called name, or returns
+	// ErrNotFound if it has not been stored.
+	DeleteVariant(id uuid.UUID, name string) error
+}
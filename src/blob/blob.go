@@ -1,26 +1,55 @@
 package blob
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 	"uuid"
 )
 
-// The directory where blobs are stored
-var StateDir = "/var/state"
+// Blob visibilities, see Blob.Private
+const (
+	Public  = "public"
+	Private = "private"
+)
+
+// ErrExpired is returned when reading the data of a blob that has expired
+var ErrExpired = errors.New("blob has expired")
+
+// ErrChecksumMismatch is returned by WriteFrom when the data written does not
+// match the checksums expected by the blob.
+var ErrChecksumMismatch = errors.New("blob data does not match checksum")
+
+// DefaultStore is the Store used by New and Get. It stores blobs on
+// disk in /var/state.
+var DefaultStore = NewStore(NewDiskBackend("/var/state"))
 
 type Blob struct {
-	ID          uuid.UUID         `json:"id"`             // Blob ID
-	Name        string            `json:"name"`           // original uploaded filename
-	ContentType string            `json:"content_type"`   // MIME type of blob
-	Size        int64             `json:"size"`           // Filesize in bytes
-	Meta        map[string]string `json:"meta,omitempty"` // Freeform meta data detected about the file
+	ID          uuid.UUID            `json:"id"`                    // Blob ID
+	Name        string               `json:"name"`                  // original uploaded filename
+	ContentType string               `json:"content_type"`          // MIME type of blob
+	Size        int64                `json:"size"`                  // Filesize in bytes
+	SHA256      string               `json:"sha256"`                // Hex encoded SHA-256 of the blob data
+	MD5         string               `json:"md5"`                   // Hex encoded MD5 of the blob data
+	Meta        map[string]string    `json:"meta,omitempty"`        // Freeform meta data detected about the file
+	VerifiedAt  *time.Time           `json:"verified_at,omitempty"` // Time the data was last verified by the scrubber
+	Corrupt     bool                 `json:"corrupt,omitempty"`     // Set when the data no longer matches its checksums
+	ExpiresAt   *time.Time           `json:"expires_at,omitempty"`  // Time after which the blob is gone and will be reaped
+	Visibility  string               `json:"visibility,omitempty"`  // Public or Private, empty is public
+	Owner       string               `json:"owner,omitempty"`       // Subject of the token that uploaded the blob
+	ACL         *ACL                 `json:"acl,omitempty"`         // Principals granted access besides the owner
+	Renditions  map[string]Rendition `json:"renditions,omitempty"`  // Renditions made from presets by preset name
 
+	store *Store // Store the blob belongs to
 }
 
 // Get the timestamp that the blob was created
@@ -28,12 +57,14 @@ func (b *Blob) Time() time.Time {
 	return b.ID.Time()
 }
 
-func (b *Blob) mkdir() error {
-	dir, err := b.dir()
-	if err != nil {
-		return err
-	}
-	return os.MkdirAll(dir, 0777)
+// Expired returns true if the blob has an expiry time that has passed
+func (b *Blob) Expired() bool {
+	return b.ExpiresAt != nil && !time.Now().Before(*b.ExpiresAt)
+}
+
+// Private returns true if reading the blob may require authorization
+func (b *Blob) Private() bool {
+	return b.Visibility == Private
 }
 
 // Valid returns true if the blob has a valid ID.
@@ -41,31 +72,33 @@ func (b *Blob) Valid() bool {
 	return b.ID.Valid()
 }
 
-// dir returns the pideon hole that the blob lives in /<StateDir>/YYYY/MM/DD/...
-func (b *Blob) dir() (string, error) {
-	if !b.Valid() {
-		return "", errors.New("attempt to generate path for ")
+// backend returns the Backend of the store the blob belongs to.
+// Blobs that were not created via a Store use the DefaultStore.
+func (b *Blob) backend() Backend {
+	if b.store == nil {
+		return DefaultStore.backend
 	}
-	if StateDir == "" {
-		return "", errors.New("invalid state dir")
-	}
-	time := b.ID.Time()
-	path := []string{
-		StateDir,
-		time.Format("2006"),
-		time.Format("01"),
-		time.Format("06"),
+	return b.store.backend
+}
+
+// metaLock returns the lock on metadata updates of the blob, which it
+// shares with the other blobs of its store that hash to the same lock
+func (b *Blob) metaLock() *sync.Mutex {
+	s := b.store
+	if s == nil {
+		s = DefaultStore
 	}
-	return filepath.Join(path...), nil
+	h := fnv.New32a()
+	h.Write(b.ID[:])
+	return &s.metaMu[h.Sum32()%uint32(len(s.metaMu))]
 }
 
-// path returns the path to the blob data
-func (b *Blob) path() (string, error) {
-	dir, err := b.dir()
-	if err != nil {
-		return "", err
+// index returns the Index of the store the blob belongs to, if any
+func (b *Blob) index() *Index {
+	if b.store == nil {
+		return DefaultStore.index
 	}
-	return filepath.Join(dir, b.ID.String()), nil
+	return b.store.index
 }
 
 // Exists returns true if the blob is valid and has a data file
@@ -73,45 +106,33 @@ func (b *Blob) Exists() bool {
 	if !b.Valid() {
 		return false
 	}
-	filename, err := b.Path()
-	if err != nil {
+	if _, err := b.backend().Stat(b.ID); err != nil {
 		return false
 	}
-	if _, err := os.Stat(filename); err == nil {
-		return true
-	}
-	return false
+	return true
 }
 
-// path returns the local filesystem path of to the blob data
-// Blobs are stored in the state dir at /YYYY/MM/DD/UUID
-// The UUID is always a v1, so this path can be calculated
-// from the UUID alone.
+// Path returns the local filesystem path of to the blob data
+// Blobs are stored in the state dir at /YYYY/MM/DD/UUID, or in the
+// directories of another Layout.
+// Only blobs in a store with a local filesystem backend have a path.
 func (b *Blob) Path() (string, error) {
-	return b.path()
-}
-
-// metadataPath returns the local filesystem path of the metadata json
-func (b *Blob) metadataPath() (string, error) {
-	path, err := b.path()
-	if err != nil {
-		return "", err
+	p, ok := b.backend().(pather)
+	if !ok {
+		return "", errors.New("blob backend does not store data on the local filesystem")
 	}
-	return fmt.Sprintf("%s.json", path), nil
+	return p.Path(b.ID)
 }
 
 func (b *Blob) unmarshal() error {
-	path, err := b.metadataPath()
-	if err != nil {
-		return err
+	if !b.Valid() {
+		return errors.New("attempt to load metadata for invalid blob")
 	}
-	f, err := os.Open(path)
+	data, err := b.backend().ReadMeta(b.ID)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
-	err = dec.Decode(b)
+	err = json.Unmarshal(data, b)
 	if err != nil {
 		return err
 	}
@@ -119,80 +140,223 @@ func (b *Blob) unmarshal() error {
 }
 
 func (b *Blob) marshal() error {
-	if err := b.mkdir(); err != nil {
-		return err
+	if !b.Valid() {
+		return errors.New("attempt to store metadata for invalid blob")
 	}
-	path, err := b.metadataPath()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err := enc.Encode(b)
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
+	if err := b.backend().WriteMeta(b.ID, buf.Bytes()); err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	err = enc.Encode(b)
-	if err != nil {
-		return err
+	if idx := b.index(); idx != nil {
+		return idx.Put(b)
 	}
 	return nil
 }
 
-func (b *Blob) WriteFrom(src io.Reader) error {
-	if err := b.mkdir(); err != nil {
+// update reloads the metadata of the blob, applies change to it and stores
+// it, then replaces b with the result. Updates and deletes hold the same
+// lock, so concurrent updates are all kept and a deleted blob is never
+// written back; its update fails with ErrNotFound.
+func (b *Blob) update(change func(fresh *Blob)) error {
+	mu := b.metaLock()
+	mu.Lock()
+	defer mu.Unlock()
+	fresh := &Blob{ID: b.ID, store: b.store}
+	if err := fresh.unmarshal(); err != nil {
 		return err
 	}
-	path, err := b.path()
-	if err != nil {
+	change(fresh)
+	if err := fresh.marshal(); err != nil {
 		return err
 	}
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return err
+	*b = *fresh
+	return nil
+}
+
+// WriteFrom stores the data read from src as the blob data followed by the
+// blob metadata. If either fails anything written is removed, so the blob is
+// either fully stored or absent.
+// Checksums of the data are computed as it is written. If SHA256 or MD5 are
+// already set they are treated as expected values and ErrChecksumMismatch is
+// returned if the data does not match.
+func (b *Blob) WriteFrom(src io.Reader) error {
+	if !b.Valid() {
+		return errors.New("attempt to write data for invalid blob")
 	}
-	defer f.Close()
-	b.Size, err = io.Copy(f, src)
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	var err error
+	b.Size, err = b.backend().Put(b.ID, io.TeeReader(src, io.MultiWriter(sha256Hash, md5Hash)))
 	if err != nil {
+		// Remove any partially written data
+		b.backend().Delete(b.ID)
 		return err
 	}
+	sha256Sum := hex.EncodeToString(sha256Hash.Sum(nil))
+	md5Sum := hex.EncodeToString(md5Hash.Sum(nil))
+	if (b.SHA256 != "" && !strings.EqualFold(b.SHA256, sha256Sum)) || (b.MD5 != "" && !strings.EqualFold(b.MD5, md5Sum)) {
+		b.backend().Delete(b.ID)
+		return ErrChecksumMismatch
+	}
+	b.SHA256 = sha256Sum
+	b.MD5 = md5Sum
 	if err := b.marshal(); err != nil {
-		return nil
+		b.backend().Delete(b.ID)
+		return err
 	}
 	return nil
 }
 
-// File returns a new open read-only *os.File for the blob data.
+// File returns a new open read-only File for the blob data.
+// ErrExpired or ErrCorrupt are returned if the blob has expired or the data
+// failed verification.
 // Users must close the file.
-func (b *Blob) File() (*os.File, error) {
+func (b *Blob) File() (File, error) {
+	if b.Expired() {
+		return nil, ErrExpired
+	}
+	if b.Corrupt {
+		return nil, ErrCorrupt
+	}
 	if !b.Exists() {
 		return nil, fmt.Errorf("blob does not have any data to read")
 	}
-	path, err := b.path()
-	if err != nil {
-		return nil, err
+	return b.backend().Open(b.ID)
+}
+
+// Delete removes the blob data and metadata from its store
+func (b *Blob) Delete() error {
+	if !b.Valid() {
+		return errors.New("attempt to delete invalid blob")
 	}
-	f, err := os.OpenFile(path, os.O_RDONLY, 0666)
-	if err != nil {
-		return nil, err
+	mu := b.metaLock()
+	mu.Lock()
+	defer mu.Unlock()
+	if err := b.backend().Delete(b.ID); err != nil {
+		return err
+	}
+	if idx := b.index(); idx != nil {
+		return idx.Remove(b.ID)
 	}
-	return f, nil
+	return nil
+}
+
+// Store creates and loads blobs kept in a Backend.
+type Store struct {
+	backend Backend
+	index   *Index
+	metaMu  [64]sync.Mutex // Serialize metadata updates and deletes of the blobs hashed to each, see Blob.update
+}
+
+// NewStore returns a *Store that keeps blobs in backend
+func NewStore(backend Backend) *Store {
+	return &Store{
+		backend: backend,
+	}
+}
+
+// Backend returns the Backend the store keeps blobs in
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
+// SetIndex sets the Index that is kept up to date as blobs are written and
+// deleted, and used to List blobs.
+func (s *Store) SetIndex(idx *Index) {
+	s.index = idx
+}
+
+// Index returns the Index of the store, or nil if it has none
+func (s *Store) Index() *Index {
+	return s.index
+}
+
+// List returns a page of blobs matching q and the cursor for the next page
+// from the store Index.
+func (s *Store) List(q Query) ([]*Blob, uuid.UUID, error) {
+	if s.index == nil {
+		return nil, uuid.UUID{}, ErrNoIndex
+	}
+	blobs, next := s.index.Query(q)
+	for _, b := range blobs {
+		b.store = s
+	}
+	return blobs, next, nil
+}
+
+// Reap deletes the blobs in the store that have expired and returns their
+// IDs. The index is used to find expired blobs if the store has one,
+// otherwise every blob in the backend is checked.
+func (s *Store) Reap() ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	if s.index != nil {
+		ids = s.index.Expired()
+	} else {
+		walker, ok := s.backend.(Walker)
+		if !ok {
+			return nil, errors.New("blob backend does not support walking blobs")
+		}
+		err := walker.Walk(func(id uuid.UUID) error {
+			b, err := s.Get(id)
+			if err == nil && b.Expired() {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	deleted := []uuid.UUID{}
+	for _, id := range ids {
+		b, err := s.Get(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		if !b.Expired() {
+			continue
+		}
+		if err := b.Delete(); err != nil && err != ErrNotFound {
+			return deleted, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, nil
 }
 
 // New returns a *Blob with a new ID set
-func New() *Blob {
-	b := &Blob{}
+func (s *Store) New() *Blob {
+	b := &Blob{store: s}
 	b.ID = uuid.TimeUUID()
 	return b
 }
 
 // Get loads the meta data and returns the *Blob for a given UUID
-func Get(id uuid.UUID) (*Blob, error) {
+func (s *Store) Get(id uuid.UUID) (*Blob, error) {
 	b := &Blob{
-		ID: id,
+		ID:    id,
+		store: s,
 	}
 	if err := b.unmarshal(); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
+
+// New returns a *Blob with a new ID set in the DefaultStore
+func New() *Blob {
+	return DefaultStore.New()
+}
+
+// Get loads the meta data and returns the *Blob for a given UUID
+// from the DefaultStore
+func Get(id uuid.UUID) (*Blob, error) {
+	return DefaultStore.Get(id)
+}
@@ -1,16 +1,306 @@
 package blob
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	"uuid"
 )
 
 func TestBlobDir(t *testing.T) {
-	blob := New()
-	dir := blob.dir()
-	exp := time.Now().Format("2006/01/06/") + blob.ID.String()
+	blob := NewStore(NewDiskBackend("/var/state")).New()
+	dir, err := blob.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Format("2006/01/02/") + blob.ID.String()
 	if !strings.HasSuffix(dir, exp) {
 		t.Fatal("expected state dir to be like:" + exp + "\ngot:" + dir)
 	}
 }
+
+func TestMemoryStore(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	b := store.New()
+	b.Name = "hello.txt"
+	data := []byte("hello world")
+	if err := b.WriteFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if b.Size != int64(len(data)) {
+		t.Fatalf("expected size %d got: %d", len(data), b.Size)
+	}
+	if _, err := b.Path(); err == nil {
+		t.Fatal("expected memory backed blob to have no local path")
+	}
+	got, err := store.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != b.Name || got.Size != b.Size {
+		t.Fatalf("expected loaded metadata to match\ngot: %+v", got)
+	}
+	f, err := got.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	read, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("expected read bytes to equal written bytes")
+	}
+	if _, err := DefaultStore.Get(b.ID); err == nil {
+		t.Fatal("expected blob to only exist in its own store")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, store := range []*Store{NewStore(NewMemoryBackend()), NewStore(NewDiskBackend(dir))} {
+		b := store.New()
+		if err := b.WriteFrom(strings.NewReader("delete me")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Exists() {
+			t.Fatal("expected blob data to be removed")
+		}
+		if _, err := store.Get(b.ID); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound got: %v", err)
+		}
+		if err := b.Delete(); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound deleting twice got: %v", err)
+		}
+	}
+	// Nothing should be left in the state dir apart from the pideon holes
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("unexpected file left after delete: %s", path)
+		}
+		return nil
+	})
+}
+
+// slowMetaBackend is a MemoryBackend that is slow to write metadata, so
+// concurrent updates overlap
+type slowMetaBackend struct {
+	*MemoryBackend
+}
+
+func (s slowMetaBackend) WriteMeta(id uuid.UUID, data []byte) error {
+	time.Sleep(time.Millisecond)
+	return s.MemoryBackend.WriteMeta(id, data)
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	store := NewStore(slowMetaBackend{NewMemoryBackend()})
+	store.SetIndex(NewIndex())
+	b := store.New()
+	b.Owner = "alice"
+	if err := b.WriteFrom(strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent updates each reload the blob and none are lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stale, _ := store.Get(b.ID)
+			if err := stale.setRendition(strconv.Itoa(i), Rendition{Preset: "p"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	stale, _ := store.Get(b.ID)
+	if err := stale.SetAccess(Private, nil); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	got, err := store.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Private() || len(got.Renditions) != 20 {
+		t.Fatalf("expected all updates to be kept got: %s %d renditions", got.Visibility, len(got.Renditions))
+	}
+	// Deleted blobs are not written back
+	if err := got.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetAccess(Public, nil); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound updating deleted blob got: %v", err)
+	}
+	if _, err := store.Get(b.ID); err != ErrNotFound {
+		t.Fatalf("expected blob to stay deleted got: %v", err)
+	}
+	if blobs, _, _ := store.List(Query{}); len(blobs) != 0 {
+		t.Fatalf("expected no index entry for deleted blob got: %d", len(blobs))
+	}
+}
+
+// failingMetaBackend is a MemoryBackend that cannot store metadata
+type failingMetaBackend struct {
+	*MemoryBackend
+}
+
+func (failingMetaBackend) WriteMeta(id uuid.UUID, data []byte) error {
+	return errors.New("metadata write failed")
+}
+
+func TestWriteFromMetadataFailure(t *testing.T) {
+	store := NewStore(failingMetaBackend{NewMemoryBackend()})
+	b := store.New()
+	if err := b.WriteFrom(strings.NewReader("data")); err == nil {
+		t.Fatal("expected metadata write error to be returned")
+	}
+	if b.Exists() {
+		t.Fatal("expected blob data to be removed after metadata write failed")
+	}
+}
+
+func TestDiskWriteIsAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(NewDiskBackend(dir))
+	// Failing part way through must leave nothing behind
+	b := store.New()
+	err = b.WriteFrom(io.MultiReader(strings.NewReader("second"), iotest.ErrReader(errors.New("read failed"))))
+	if err == nil {
+		t.Fatal("expected read error")
+	}
+	files := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 0 {
+		t.Fatalf("expected failed write to leave no files got: %v", files)
+	}
+	b = store.New()
+	if err := b.WriteFrom(strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	path, err := b.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected only data and metadata files got %d entries", len(entries))
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	b := store.New()
+	if err := b.WriteFrom(strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"; b.SHA256 != exp {
+		t.Fatalf("expected sha256 %s got: %s", exp, b.SHA256)
+	}
+	if exp := "5eb63bbbe01eeed093cb22bb8f5acdc3"; b.MD5 != exp {
+		t.Fatalf("expected md5 %s got: %s", exp, b.MD5)
+	}
+	got, err := store.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SHA256 != b.SHA256 || got.MD5 != b.MD5 {
+		t.Fatal("expected checksums to be stored in the metadata")
+	}
+	// Expected checksums are verified
+	b = store.New()
+	b.MD5 = "5EB63BBBE01EEED093CB22BB8F5ACDC3"
+	if err := b.WriteFrom(strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	b = store.New()
+	b.SHA256 = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	if err := b.WriteFrom(strings.NewReader("hello there")); err != ErrChecksumMismatch {
+		t.Fatalf("expected ErrChecksumMismatch got: %v", err)
+	}
+	if b.Exists() {
+		t.Fatal("expected mismatched blob data to be removed")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := NewDiskBackend(dir)
+	backend.Dedup = true
+	store := NewStore(backend)
+	blobs := []*Blob{}
+	for i := 0; i < 3; i++ {
+		b := store.New()
+		if err := b.WriteFrom(strings.NewReader("same data")); err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, b)
+	}
+	other := store.New()
+	if err := other.WriteFrom(strings.NewReader("other data")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := backend.DedupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := DedupStats{Objects: 2, References: 4, StoredBytes: 19, LogicalBytes: 37, SavedBytes: 18}
+	if *stats != exp {
+		t.Fatalf("expected stats %+v got: %+v", exp, *stats)
+	}
+	// Content remains until the last reference is deleted
+	contentPath := backend.contentPath(blobs[0].SHA256)
+	for i, b := range blobs {
+		if err := b.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		_, err := os.Stat(contentPath)
+		if last := i == len(blobs)-1; last && !os.IsNotExist(err) {
+			t.Fatal("expected content to be removed with last reference")
+		} else if !last && err != nil {
+			t.Fatalf("expected content to remain while referenced: %v", err)
+		}
+	}
+	f, err := other.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "other data" {
+		t.Fatalf("expected other blob data to be intact got: %q %v", data, err)
+	}
+}
@@ -0,0 +1,154 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Deduplicated blob data is stored once per unique SHA-256 in the state dir
+// at /content/ab/cd/<sha256>. The data file of each blob is a hard link to
+// its content file, so the link count of a content file is the number of
+// blobs referencing it plus one. Content is removed when the last blob
+// referencing it is deleted.
+const contentDir = "content"
+
+// contentPath returns the path of the content file for the hex sha256
+func (d *DiskBackend) contentPath(sum string) string {
+	return filepath.Join(d.Dir, contentDir, sum[0:2], sum[2:4], sum)
+}
+
+// putDedup writes src to the content store and links path to it
+func (d *DiskBackend) putDedup(path string, src io.Reader) (int64, error) {
+	root := filepath.Join(d.Dir, contentDir)
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	tmp, n, err := writeTemp(root, ".tmp", io.TeeReader(src, h))
+	if err != nil {
+		return n, err
+	}
+	defer os.Remove(tmp)
+	cpath := d.contentPath(hex.EncodeToString(h.Sum(nil)))
+	if err := os.MkdirAll(filepath.Dir(cpath), 0777); err != nil {
+		return n, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := os.Stat(cpath); os.IsNotExist(err) {
+		if err := os.Rename(tmp, cpath); err != nil {
+			return n, err
+		}
+		if err := syncDir(filepath.Dir(cpath)); err != nil {
+			return n, err
+		}
+	} else if err != nil {
+		return n, err
+	}
+	os.Remove(path)
+	if err := os.Link(cpath, path); err != nil {
+		return n, err
+	}
+	return n, syncDir(filepath.Dir(path))
+}
+
+// removeData removes the blob data file at path. If the file is linked to
+// deduplicated content, the content is removed too once no other blobs
+// reference it. metaPath is used to find the content checksum.
+func (d *DiskBackend) removeData(path, metaPath string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if n, ok := linkCount(fi); !ok || n < 2 {
+		return os.Remove(path)
+	}
+	sum, err := contentSum(path, metaPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	cpath := d.contentPath(sum)
+	cfi, err := os.Stat(cpath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if n, ok := linkCount(cfi); ok && n == 1 && os.SameFile(fi, cfi) {
+		return os.Remove(cpath)
+	}
+	return nil
+}
+
+// contentSum returns the hex sha256 of the blob data, taken from the
+// metadata at metaPath if possible or else by hashing the data at path.
+func contentSum(path, metaPath string) (string, error) {
+	var meta struct {
+		SHA256 string `json:"sha256"`
+	}
+	if data, err := ioutil.ReadFile(metaPath); err == nil {
+		if json.Unmarshal(data, &meta) == nil && len(meta.SHA256) == sha256.Size*2 {
+			return meta.SHA256, nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DedupStats reports the space saved by deduplication
+type DedupStats struct {
+	Objects      int64 `json:"objects"`       // Number of unique content files
+	References   int64 `json:"references"`    // Number of blobs referencing content
+	StoredBytes  int64 `json:"stored_bytes"`  // Bytes used by unique content
+	LogicalBytes int64 `json:"logical_bytes"` // Bytes referencing blobs would use without deduplication
+	SavedBytes   int64 `json:"saved_bytes"`   // LogicalBytes - StoredBytes
+}
+
+// DedupStats walks the content store and reports the space saved
+func (d *DiskBackend) DedupStats() (*DedupStats, error) {
+	stats := &DedupStats{}
+	root := filepath.Join(d.Dir, contentDir)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if fi.IsDir() || filepath.Dir(path) == root {
+			return nil // skip temp files in the root
+		}
+		n, ok := linkCount(fi)
+		if !ok {
+			return nil
+		}
+		refs := int64(n) - 1
+		stats.Objects++
+		stats.References += refs
+		stats.StoredBytes += fi.Size()
+		stats.LogicalBytes += fi.Size() * refs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.SavedBytes = stats.LogicalBytes - stats.StoredBytes
+	return stats, nil
+}
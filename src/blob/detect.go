@@ -0,0 +1,131 @@
+package blob
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// A Detector returns metadata detected about blob data of size bytes read
+// from r. Detectors are best effort: data they do not understand should be
+// reported with an error, which leaves the metadata of the blob unchanged.
+type Detector func(r io.ReaderAt, size int64) (map[string]string, error)
+
+// registeredDetector is a Detector and the content types it is for
+type registeredDetector struct {
+	contentType string
+	detect      Detector
+}
+
+// detectors are the registered detectors in the order they run
+var detectors struct {
+	sync.RWMutex
+	list []registeredDetector
+}
+
+// RegisterDetector adds a Detector run on blobs of contentType, which is an
+// exact MIME type or a prefix ending in "/" such as "image/". Detectors run
+// in the order they were registered, so later detectors override the keys
+// of earlier ones.
+func RegisterDetector(contentType string, d Detector) {
+	detectors.Lock()
+	defer detectors.Unlock()
+	detectors.list = append(detectors.list, registeredDetector{strings.ToLower(contentType), d})
+}
+
+// saveDetectors returns a func that restores the registered detectors to
+// those registered now, so tests can register their own
+func saveDetectors() func() {
+	detectors.RLock()
+	defer detectors.RUnlock()
+	saved := append([]registeredDetector(nil), detectors.list...)
+	return func() {
+		detectors.Lock()
+		defer detectors.Unlock()
+		detectors.list = saved
+	}
+}
+
+// detectorsFor returns the detectors registered for contentType
+func detectorsFor(contentType string) []Detector {
+	contentType = mediaType(contentType)
+	detectors.RLock()
+	defer detectors.RUnlock()
+	list := []Detector{}
+	for _, d := range detectors.list {
+		if d.contentType == contentType || strings.HasSuffix(d.contentType, "/") && strings.HasPrefix(contentType, d.contentType) {
+			list = append(list, d.detect)
+		}
+	}
+	return list
+}
+
+// DetectMeta runs the detectors registered for the content type of the blob
+// over its data and stores what they find in Meta.
+func (b *Blob) DetectMeta() error {
+	list := detectorsFor(b.ContentType)
+	if len(list) == 0 {
+		return nil
+	}
+	f, err := b.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		r = &seekReaderAt{f: f}
+	}
+	found := map[string]string{}
+	for _, detect := range list {
+		meta, err := runDetector(detect, r, b.Size)
+		if err != nil {
+			continue
+		}
+		for k, v := range meta {
+			found[k] = v
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return b.update(func(fresh *Blob) {
+		if fresh.Meta == nil {
+			fresh.Meta = map[string]string{}
+		}
+		for k, v := range found {
+			fresh.Meta[k] = v
+		}
+	})
+}
+
+// runDetector runs detect, returning a panic as an error so that a faulty
+// detector cannot take down the upload it runs in
+func runDetector(detect Detector, r io.ReaderAt, size int64) (meta map[string]string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			meta, err = nil, fmt.Errorf("detector panicked: %v", p)
+		}
+	}()
+	return detect(r, size)
+}
+
+// seekReaderAt implements io.ReaderAt for files that can only seek
+type seekReaderAt struct {
+	mu sync.Mutex
+	f  File
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
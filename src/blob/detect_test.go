@@ -0,0 +1,172 @@
+package blob
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDetectMeta(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	detect := func(contentType string, data []byte) map[string]string {
+		b := store.New()
+		b.ContentType = contentType
+		if err := b.WriteFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DetectMeta(); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := store.Get(b.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored.Meta
+	}
+	pngData := new(bytes.Buffer)
+	png.Encode(pngData, image.NewRGBA(image.Rect(0, 0, 3, 2)))
+	gifData := new(bytes.Buffer)
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 5), palette.Plan9)
+	gif.EncodeAll(gifData, &gif.GIF{Image: []*image.Paletted{frame, frame, frame}, Delay: []int{0, 0, 0}})
+	pdf := "%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R >> endobj\n" +
+		"4 0 obj << /Type/Page/Parent 2 0 R >> endobj\n%%EOF\n"
+	// Page objects either side of the chunk boundary
+	bigPDF := pdf + strings.Repeat(" ", 64*1024-len(pdf)-5) + "<< /Type /Page >>" + strings.Repeat(" ", 64*1024)
+	wav := new(bytes.Buffer)
+	wav.WriteString("RIFF\x00\x00\x00\x00WAVEfmt ")
+	binary.Write(wav, binary.LittleEndian, []uint32{16, 0x00010001, 8000, 16000, 0x00100002})
+	wav.WriteString("data")
+	binary.Write(wav, binary.LittleEndian, uint32(24000))
+	wav.Write(make([]byte, 24000))
+	mp4 := new(bytes.Buffer)
+	atom := func(typ string, content []byte) []byte {
+		b := new(bytes.Buffer)
+		binary.Write(b, binary.BigEndian, uint32(8+len(content)))
+		b.WriteString(typ)
+		b.Write(content)
+		return b.Bytes()
+	}
+	mvhd := new(bytes.Buffer)
+	binary.Write(mvhd, binary.BigEndian, []uint32{0, 0, 0, 1000, 2500})
+	mvhd.Write(make([]byte, 80))
+	mp4.Write(atom("ftyp", []byte("isom0000")))
+	mp4.Write(atom("moov", atom("mvhd", mvhd.Bytes())))
+	zipData := new(bytes.Buffer)
+	zw := zip.NewWriter(zipData)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(name))
+	}
+	zw.Close()
+	tarGz := new(bytes.Buffer)
+	gw := gzip.NewWriter(tarGz)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{"a", "b", "c"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1})
+		tw.Write([]byte("x"))
+	}
+	tw.Close()
+	gw.Close()
+
+	cases := []struct {
+		contentType string
+		data        []byte
+		exp         map[string]string
+	}{
+		{"image/png", pngData.Bytes(), map[string]string{"width": "3", "height": "2", "format": "png"}},
+		{"image/gif", gifData.Bytes(), map[string]string{"width": "4", "height": "5", "format": "gif", "frames": "3"}},
+		{"application/pdf", []byte(pdf), map[string]string{"pages": "2"}},
+		{"application/pdf", []byte(bigPDF), map[string]string{"pages": "3"}},
+		{"audio/wav", wav.Bytes(), map[string]string{"duration": "1.500"}},
+		{"video/mp4", mp4.Bytes(), map[string]string{"duration": "2.500"}},
+		{"text/plain; charset=utf-8", []byte("one\ntwo\nthree"), map[string]string{"encoding": "us-ascii", "lines": "3"}},
+		{"text/plain", []byte("caf\xc3\xa9\n"), map[string]string{"encoding": "utf-8", "lines": "1"}},
+		{"text/plain", []byte("caf\xe9\n"), map[string]string{"encoding": "unknown", "lines": "1"}},
+		{"text/plain", []byte("\xff\xfea\x00\n\x00b\x00"), map[string]string{"encoding": "utf-16le", "lines": "2"}},
+		{"application/zip", zipData.Bytes(), map[string]string{"entries": "2"}},
+		{"application/gzip", tarGz.Bytes(), map[string]string{"entries": "3"}},
+		{"image/png", []byte("not a png"), nil},
+		{"application/octet-stream", pngData.Bytes(), nil},
+	}
+	for _, c := range cases {
+		meta := detect(c.contentType, c.data)
+		if len(meta) != len(c.exp) {
+			t.Errorf("%s: expected meta %v got: %v", c.contentType, c.exp, meta)
+			continue
+		}
+		for k, v := range c.exp {
+			if meta[k] != v {
+				t.Errorf("%s: expected meta %v got: %v", c.contentType, c.exp, meta)
+				break
+			}
+		}
+	}
+}
+
+func TestRegisterDetector(t *testing.T) {
+	t.Cleanup(saveDetectors())
+	RegisterDetector("application/x-custom", func(r io.ReaderAt, size int64) (map[string]string, error) {
+		return map[string]string{"custom": "yes"}, nil
+	})
+	RegisterDetector("application/", func(r io.ReaderAt, size int64) (map[string]string, error) {
+		return nil, errors.New("not understood")
+	})
+	RegisterDetector("application/", func(r io.ReaderAt, size int64) (map[string]string, error) {
+		panic("faulty detector")
+	})
+	store := NewStore(NewMemoryBackend())
+	b := store.New()
+	b.ContentType = "application/x-custom"
+	b.Meta = map[string]string{"kept": "yes"}
+	if err := b.WriteFrom(strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetectMeta(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Meta["custom"] != "yes" || b.Meta["kept"] != "yes" {
+		t.Fatalf("expected detected meta to be merged got: %v", b.Meta)
+	}
+}
+
+func TestDetectArchiveLimits(t *testing.T) {
+	// A gzipped tar of one large entry and one small one
+	tarGz := new(bytes.Buffer)
+	gw := gzip.NewWriter(tarGz)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "zeros", Mode: 0644, Size: 1 << 20})
+	tw.Write(make([]byte, 1<<20))
+	tw.WriteHeader(&tar.Header{Name: "small", Mode: 0644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+	gw.Close()
+	detect := func() (map[string]string, error) {
+		return detectTarGzEntries(bytes.NewReader(tarGz.Bytes()), int64(tarGz.Len()))
+	}
+	if meta, err := detect(); err != nil || meta["entries"] != "2" {
+		t.Fatalf("expected 2 entries got: %v %v", meta, err)
+	}
+	defer func(entries int, size int64) {
+		MaxArchiveEntries, MaxDecompressedBytes = entries, size
+	}(MaxArchiveEntries, MaxDecompressedBytes)
+	MaxDecompressedBytes = 64 * 1024
+	if _, err := detect(); err != errArchiveTooLarge {
+		t.Errorf("expected errArchiveTooLarge over decompressed limit got: %v", err)
+	}
+	MaxDecompressedBytes, MaxArchiveEntries = 2<<20, 1
+	if _, err := detect(); err != errArchiveTooLarge {
+		t.Errorf("expected errArchiveTooLarge over entry limit got: %v", err)
+	}
+}
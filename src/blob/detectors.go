@@ -0,0 +1,469 @@
+package blob
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"  // register formats for image.DecodeConfig
+	_ "image/jpeg" // register formats for image.DecodeConfig
+	_ "image/png"  // register formats for image.DecodeConfig
+	"io"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The built in detectors
+func init() {
+	RegisterDetector("image/", detectImage)
+	RegisterDetector("image/gif", detectGIFFrames)
+	RegisterDetector("application/pdf", detectPDFPages)
+	for _, t := range []string{"audio/wav", "audio/wave", "audio/x-wav", "audio/vnd.wave"} {
+		RegisterDetector(t, detectWAVDuration)
+	}
+	for _, t := range []string{"video/mp4", "audio/mp4", "video/quicktime", "audio/x-m4a", "video/x-m4v", "video/3gpp"} {
+		RegisterDetector(t, detectMP4Duration)
+	}
+	for _, t := range []string{"text/", "application/json", "application/xml", "application/javascript", "application/x-yaml"} {
+		RegisterDetector(t, detectText)
+	}
+	for _, t := range []string{"application/zip", "application/x-zip-compressed", "application/java-archive", "application/epub+zip"} {
+		RegisterDetector(t, detectZipEntries)
+	}
+	RegisterDetector("application/x-tar", detectTarEntries)
+	for _, t := range []string{"application/gzip", "application/x-gzip", "application/x-gtar", "application/x-compressed-tar"} {
+		RegisterDetector(t, detectTarGzEntries)
+	}
+}
+
+// Limits on the archives examined by the detectors, which run while the
+// upload request waits, so a small compressed upload cannot keep them busy
+var (
+	MaxArchiveEntries          = 100000    // Entries counted before giving up
+	MaxDecompressedBytes int64 = 256 << 20 // Bytes decompressed before giving up
+)
+
+// errArchiveTooLarge is returned by detectors for archives over the limits
+var errArchiveTooLarge = errors.New("archive too large to examine")
+
+// readAt reads exactly n bytes at off
+func readAt(r io.ReaderAt, n int, off int64) ([]byte, error) {
+	b := make([]byte, n)
+	read, err := r.ReadAt(b, off)
+	if read == n {
+		return b, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// formatSeconds formats a duration in seconds with millisecond precision
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+// detectImage records the width, height and format of images in the
+// formats registered with the image package
+func detectImage(r io.ReaderAt, size int64) (map[string]string, error) {
+	cfg, format, err := image.DecodeConfig(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"width":  strconv.Itoa(cfg.Width),
+		"height": strconv.Itoa(cfg.Height),
+		"format": format,
+	}, nil
+}
+
+// detectGIFFrames records the number of frames of a GIF by walking its
+// blocks without decoding the images
+func detectGIFFrames(r io.ReaderAt, size int64) (map[string]string, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if string(header[:3]) != "GIF" {
+		return nil, errors.New("not a GIF")
+	}
+	// Global color table
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (header[10]&7 + 1)); err != nil {
+			return nil, err
+		}
+	}
+	skipSubBlocks := func() error {
+		for {
+			n, err := br.ReadByte()
+			if err != nil || n == 0 {
+				return err
+			}
+			if _, err := br.Discard(int(n)); err != nil {
+				return err
+			}
+		}
+	}
+	frames := 0
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case 0x21: // extension
+			if _, err := br.ReadByte(); err != nil {
+				return nil, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return nil, err
+			}
+		case 0x2C: // image descriptor
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(br, desc); err != nil {
+				return nil, err
+			}
+			if desc[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << (desc[8]&7 + 1)); err != nil {
+					return nil, err
+				}
+			}
+			// LZW minimum code size then the image data
+			if _, err := br.ReadByte(); err != nil {
+				return nil, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return nil, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return map[string]string{"frames": strconv.Itoa(frames)}, nil
+		default:
+			return nil, errors.New("invalid GIF block")
+		}
+	}
+}
+
+// pdfPage matches the dictionary type of a PDF page object
+var pdfPage = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// detectPDFPages records the number of page objects in a PDF. Pages kept
+// in compressed object streams are not found, in which case nothing is
+// recorded.
+func detectPDFPages(r io.ReaderAt, size int64) (map[string]string, error) {
+	if header, err := readAt(r, 5, 0); err != nil || string(header) != "%PDF-" {
+		return nil, errors.New("not a PDF")
+	}
+	pages, err := countMatches(io.NewSectionReader(r, 0, size), pdfPage, 64)
+	if err != nil {
+		return nil, err
+	}
+	if pages == 0 {
+		return nil, errors.New("no PDF pages found")
+	}
+	return map[string]string{"pages": strconv.Itoa(pages)}, nil
+}
+
+// countMatches counts the matches of re in the data read from src in
+// chunks. Matches must be shorter than overlap bytes.
+func countMatches(src io.Reader, re *regexp.Regexp, overlap int) (int, error) {
+	buf := make([]byte, 0, 64*1024+overlap)
+	count := 0
+	for {
+		n, err := io.ReadFull(src, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+		// Matches starting in the overlap are counted with the next chunk
+		limit := len(buf) - overlap
+		if final {
+			limit = len(buf)
+		}
+		for _, m := range re.FindAllIndex(buf, -1) {
+			if m[0] < limit {
+				count++
+			}
+		}
+		if final {
+			return count, nil
+		}
+		buf = buf[:copy(buf, buf[limit:])]
+	}
+}
+
+// detectWAVDuration records the duration of a WAV file from the byte rate
+// of its fmt chunk and the size of its data chunk
+func detectWAVDuration(r io.ReaderAt, size int64) (map[string]string, error) {
+	header, err := readAt(r, 12, 0)
+	if err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return nil, errors.New("not a WAV")
+	}
+	var byteRate uint32
+	dataSize := int64(-1)
+	for off := int64(12); off+8 <= size; {
+		chunk, err := readAt(r, 8, off)
+		if err != nil {
+			return nil, err
+		}
+		n := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch string(chunk[:4]) {
+		case "fmt ":
+			format, err := readAt(r, 16, off+8)
+			if err != nil {
+				return nil, err
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:12])
+		case "data":
+			// Streamed files may not have the real size
+			dataSize = n
+			if off+8+n > size {
+				dataSize = size - off - 8
+			}
+		}
+		off += 8 + n + n%2
+	}
+	if byteRate == 0 || dataSize < 0 {
+		return nil, errors.New("WAV has no audio")
+	}
+	return map[string]string{"duration": formatSeconds(float64(dataSize) / float64(byteRate))}, nil
+}
+
+// detectMP4Duration records the duration of an MP4 or QuickTime file from
+// its movie header atom
+func detectMP4Duration(r io.ReaderAt, size int64) (map[string]string, error) {
+	moov, moovSize, err := findAtom(r, 0, size, "moov")
+	if err != nil {
+		return nil, err
+	}
+	mvhd, mvhdSize, err := findAtom(r, moov, moov+moovSize, "mvhd")
+	if err != nil {
+		return nil, err
+	}
+	var timescale uint32
+	var duration uint64
+	version, err := readAt(r, 1, mvhd)
+	if err != nil {
+		return nil, err
+	}
+	if version[0] == 1 {
+		if mvhdSize < 32 {
+			return nil, errors.New("short mvhd atom")
+		}
+		h, err := readAt(r, 32, mvhd)
+		if err != nil {
+			return nil, err
+		}
+		timescale = binary.BigEndian.Uint32(h[20:24])
+		duration = binary.BigEndian.Uint64(h[24:32])
+	} else {
+		if mvhdSize < 20 {
+			return nil, errors.New("short mvhd atom")
+		}
+		h, err := readAt(r, 20, mvhd)
+		if err != nil {
+			return nil, err
+		}
+		timescale = binary.BigEndian.Uint32(h[12:16])
+		duration = uint64(binary.BigEndian.Uint32(h[16:20]))
+	}
+	if timescale == 0 {
+		return nil, errors.New("mvhd atom has no timescale")
+	}
+	return map[string]string{"duration": formatSeconds(float64(duration) / float64(timescale))}, nil
+}
+
+// findAtom returns the offset and size of the content of the first atom of
+// type typ between start and end
+func findAtom(r io.ReaderAt, start, end int64, typ string) (int64, int64, error) {
+	for off := start; off+8 <= end; {
+		h, err := readAt(r, 8, off)
+		if err != nil {
+			return 0, 0, err
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(h[:4])), int64(8)
+		switch size {
+		case 0: // extends to the end
+			size = end - off
+		case 1: // 64 bit size follows the type
+			ext, err := readAt(r, 8, off+8)
+			if err != nil {
+				return 0, 0, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(ext)), 16
+		}
+		if size < headerSize || off+size > end {
+			return 0, 0, errors.New("invalid atom size")
+		}
+		if string(h[4:8]) == typ {
+			return off + headerSize, size - headerSize, nil
+		}
+		off += size
+	}
+	return 0, 0, errors.New("no " + typ + " atom")
+}
+
+// detectText records the encoding of text and the number of lines. The
+// encoding is us-ascii or utf-8 if the text is valid as either, utf-16le or
+// utf-16be if the text starts with their byte order mark, and unknown
+// otherwise.
+func detectText(r io.ReaderAt, size int64) (map[string]string, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	bom, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(bom, []byte{0xFE, 0xFF}):
+		br.Discard(2)
+		return detectUTF16(br, binary.BigEndian, "utf-16be")
+	case bytes.HasPrefix(bom, []byte{0xFF, 0xFE}):
+		br.Discard(2)
+		return detectUTF16(br, binary.LittleEndian, "utf-16le")
+	case bytes.HasPrefix(bom, []byte{0xEF, 0xBB, 0xBF}):
+		br.Discard(3)
+	}
+	ascii, valid := true, true
+	lines := 0
+	var last byte
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := br.Read(buf)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		chunk := append(pending, buf[:n]...)
+		pending = nil
+		for i := 0; i < len(chunk); {
+			c := chunk[i]
+			if c < utf8.RuneSelf {
+				if c == '\n' {
+					lines++
+				}
+				last = c
+				i++
+				continue
+			}
+			ascii = false
+			// Runes split between reads are decoded with the next read
+			if !utf8.FullRune(chunk[i:]) && err == nil {
+				pending = append([]byte{}, chunk[i:]...)
+				break
+			}
+			rn, n := utf8.DecodeRune(chunk[i:])
+			if rn == utf8.RuneError && n == 1 {
+				valid = false
+			}
+			i += n
+			last = chunk[i-1]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if size > 0 && last != '\n' {
+		lines++
+	}
+	encoding := "unknown"
+	switch {
+	case ascii:
+		encoding = "us-ascii"
+	case valid:
+		encoding = "utf-8"
+	}
+	return map[string]string{"encoding": encoding, "lines": strconv.Itoa(lines)}, nil
+}
+
+// detectUTF16 counts the lines of UTF-16 text after the byte order mark
+func detectUTF16(r io.Reader, order binary.ByteOrder, encoding string) (map[string]string, error) {
+	br := bufio.NewReader(r)
+	unit := make([]byte, 2)
+	lines := 0
+	var last uint16
+	empty := true
+	for {
+		if _, err := io.ReadFull(br, unit); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		empty = false
+		last = order.Uint16(unit)
+		if last == '\n' {
+			lines++
+		}
+	}
+	if !empty && last != '\n' {
+		lines++
+	}
+	return map[string]string{"encoding": encoding, "lines": strconv.Itoa(lines)}, nil
+}
+
+// detectZipEntries records the number of entries in a zip archive
+func detectZipEntries(r io.ReaderAt, size int64) (map[string]string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"entries": strconv.Itoa(len(zr.File))}, nil
+}
+
+// detectTarEntries records the number of entries in a tar archive
+func detectTarEntries(r io.ReaderAt, size int64) (map[string]string, error) {
+	return countTarEntries(io.NewSectionReader(r, 0, size))
+}
+
+// detectTarGzEntries records the number of entries in a gzipped tar
+// archive. Gzipped files that are not tar archives are left alone.
+func detectTarGzEntries(r io.ReaderAt, size int64) (map[string]string, error) {
+	zr, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return countTarEntries(&limitedReader{r: zr, n: MaxDecompressedBytes})
+}
+
+// limitedReader reads from r but fails with errArchiveTooLarge once n bytes
+// have been read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errArchiveTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// countTarEntries counts the entries of the tar archive read from src
+func countTarEntries(src io.Reader) (map[string]string, error) {
+	tr := tar.NewReader(src)
+	entries := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries++
+		if entries > MaxArchiveEntries {
+			return nil, errArchiveTooLarge
+		}
+	}
+	return map[string]string{"entries": strconv.Itoa(entries)}, nil
+}
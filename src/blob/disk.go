@@ -0,0 +1,364 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"uuid"
+)
+
+// DiskBackend stores blobs on the local filesystem in Dir at /YYYY/MM/DD/UUID
+// with the metadata alongside in /YYYY/MM/DD/UUID.json and any cached variants
+// in /YYYY/MM/DD/UUID.variants/, or in the directories of another Layout.
+type DiskBackend struct {
+	Dir    string // The directory where blobs are stored
+	Layout Layout // Layout new blobs are written in, defaults to DateLayout
+	Dedup  bool   // Store identical blob data only once, see dedup.go
+
+	mu sync.Mutex // Serializes changes to deduplicated content
+}
+
+// variantsExt is the extension of the directory holding the variants of a blob
+const variantsExt = ".variants"
+
+// NewDiskBackend returns a *DiskBackend storing blobs in dir
+func NewDiskBackend(dir string) *DiskBackend {
+	return &DiskBackend{
+		Dir: dir,
+	}
+}
+
+// dirs returns the pideon holes that the blob may live in /<Dir>/YYYY/MM/DD/...
+// starting with the one new blobs are written to
+func (d *DiskBackend) dirs(id uuid.UUID) ([]string, error) {
+	if !id.Valid() {
+		return nil, errors.New("attempt to generate path for invalid blob id")
+	}
+	if d.Dir == "" {
+		return nil, errors.New("invalid state dir")
+	}
+	dirs := d.Layout.searchDirs(id)
+	for i, dir := range dirs {
+		dirs[i] = filepath.Join(d.Dir, filepath.FromSlash(dir))
+	}
+	return dirs, nil
+}
+
+// dir returns the pideon hole that new blobs are written to
+func (d *DiskBackend) dir(id uuid.UUID) (string, error) {
+	dirs, err := d.dirs(id)
+	if err != nil {
+		return "", err
+	}
+	return dirs[0], nil
+}
+
+func (d *DiskBackend) mkdir(id uuid.UUID) error {
+	dir, err := d.dir(id)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0777)
+}
+
+// lookup calls fn with the path of the blob file with extension ext in each
+// of the directories the blob may live in, until fn does not fail with a
+// not exist error. The search is repeated once as a concurrent migration may
+// move the file between directories.
+func (d *DiskBackend) lookup(id uuid.UUID, ext string, fn func(path string) error) error {
+	dirs, err := d.dirs(id)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		for _, dir := range dirs {
+			if err = fn(filepath.Join(dir, id.String()+ext)); !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// find returns the path of the existing blob file with extension ext, or
+// the path new files are written to if there is none.
+func (d *DiskBackend) find(id uuid.UUID, ext string) (string, error) {
+	var found string
+	err := d.lookup(id, ext, func(path string) error {
+		_, err := os.Lstat(path)
+		found = path
+		return err
+	})
+	if os.IsNotExist(err) {
+		dir, err := d.dir(id)
+		return filepath.Join(dir, id.String()+ext), err
+	}
+	return found, err
+}
+
+// Path returns the local filesystem path of the blob data
+// The UUID is always a v1, so this path can be calculated
+// from the UUID alone.
+func (d *DiskBackend) Path(id uuid.UUID) (string, error) {
+	return d.find(id, "")
+}
+
+// writeTemp writes src to a new fsynced temporary file in dir and returns
+// its name. The file is removed on failure.
+func writeTemp(dir, prefix string, src io.Reader) (name string, n int64, err error) {
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if n, err = io.Copy(f, src); err != nil {
+		return "", n, err
+	}
+	if err = f.Chmod(0644); err != nil {
+		return "", n, err
+	}
+	if err = f.Sync(); err != nil {
+		return "", n, err
+	}
+	if err = f.Close(); err != nil {
+		return "", n, err
+	}
+	return f.Name(), n, nil
+}
+
+// writeFileAtomic writes src to a temporary file in the same directory as
+// path, fsyncs it and renames it into place, so readers only ever see the
+// complete file. The directory is fsynced so that the rename is durable.
+func writeFileAtomic(path string, src io.Reader) (int64, error) {
+	dir := filepath.Dir(path)
+	tmp, n, err := writeTemp(dir, "."+filepath.Base(path)+".tmp", src)
+	if err != nil {
+		return n, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that changes to its entries are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Put writes the blob data to disk
+func (d *DiskBackend) Put(id uuid.UUID, src io.Reader) (int64, error) {
+	if err := d.mkdir(id); err != nil {
+		return 0, err
+	}
+	dir, err := d.dir(id)
+	if err != nil {
+		return 0, err
+	}
+	path := filepath.Join(dir, id.String())
+	if d.Dedup {
+		return d.putDedup(path, src)
+	}
+	return writeFileAtomic(path, src)
+}
+
+// Open returns a new open read-only *os.File for the blob data.
+func (d *DiskBackend) Open(id uuid.UUID) (File, error) {
+	var f *os.File
+	err := d.lookup(id, "", func(path string) (err error) {
+		f, err = os.OpenFile(path, os.O_RDONLY, 0666)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat returns the size of the blob data file
+func (d *DiskBackend) Stat(id uuid.UUID) (int64, error) {
+	var fi os.FileInfo
+	err := d.lookup(id, "", func(path string) (err error) {
+		fi, err = os.Stat(path)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Delete removes the blob data, metadata and variant files from every
+// directory the blob may live in. The metadata is first renamed out of the
+// way so that the blob disappears atomically, even if the data file removal
+// fails. Any data without metadata, as left by a failed write, is removed
+// too.
+func (d *DiskBackend) Delete(id uuid.UUID) error {
+	dirs, err := d.dirs(id)
+	if err != nil {
+		return err
+	}
+	found := false
+	// Older layouts first, so that a concurrent migration cannot move files
+	// into a directory that was already cleared
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dirs[i], id.String())
+		tombstone := path + ".json.deleted"
+		err := os.Rename(path+".json", tombstone)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		exists := err == nil
+		if err := d.removeData(path, tombstone); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(path + variantsExt); err != nil {
+			return err
+		}
+		if exists {
+			found = true
+			if err := os.Remove(tombstone); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PutVariant writes a variant of the blob data to the directory of variants
+// next to the data file
+func (d *DiskBackend) PutVariant(id uuid.UUID, name string, src io.Reader) error {
+	if !validVariantName(name) {
+		return fmt.Errorf("invalid variant name %q", name)
+	}
+	path, err := d.find(id, "")
+	if err != nil {
+		return err
+	}
+	if !exists(path) {
+		return ErrNotFound
+	}
+	dir := path + variantsExt
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	_, err = writeFileAtomic(filepath.Join(dir, name), src)
+	return err
+}
+
+// OpenVariant returns a new open read-only *os.File for a variant of the blob
+// data
+func (d *DiskBackend) OpenVariant(id uuid.UUID, name string) (File, error) {
+	if !validVariantName(name) {
+		return nil, fmt.Errorf("invalid variant name %q", name)
+	}
+	var f *os.File
+	err := d.lookup(id, variantsExt+string(filepath.Separator)+name, func(path string) (err error) {
+		f, err = os.Open(path)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DeleteVariant removes the file of a variant of the blob data
+func (d *DiskBackend) DeleteVariant(id uuid.UUID, name string) error {
+	if !validVariantName(name) {
+		return fmt.Errorf("invalid variant name %q", name)
+	}
+	err := d.lookup(id, variantsExt+string(filepath.Separator)+name, os.Remove)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// ReadMeta returns the contents of the metadata json file
+func (d *DiskBackend) ReadMeta(id uuid.UUID) ([]byte, error) {
+	var data []byte
+	err := d.lookup(id, ".json", func(path string) (err error) {
+		data, err = ioutil.ReadFile(path)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteMeta writes the metadata json file in the current layout and removes
+// any older copies left in the directories of other layouts
+func (d *DiskBackend) WriteMeta(id uuid.UUID, data []byte) error {
+	if err := d.mkdir(id); err != nil {
+		return err
+	}
+	dirs, err := d.dirs(id)
+	if err != nil {
+		return err
+	}
+	name := id.String() + ".json"
+	if _, err := writeFileAtomic(filepath.Join(dirs[0], name), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for _, dir := range dirs[1:] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for each blob metadata file found in the state dir
+func (d *DiskBackend) Walk(fn func(id uuid.UUID) error) error {
+	root := filepath.Clean(d.Dir)
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != root && filepath.Dir(path) == root && reservedDir(fi.Name()) || strings.HasSuffix(fi.Name(), variantsExt) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, ".") {
+			return nil
+		}
+		id, err := uuid.ParseUUID(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil // not a blob
+		}
+		return fn(id)
+	})
+}
@@ -0,0 +1,269 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"strconv"
+	"strings"
+)
+
+// ErrBadJPEG is returned by StripJPEG for data that is not a well formed JPEG
+var ErrBadJPEG = errors.New("invalid jpeg data")
+
+// MaxStripSize limits the size in bytes of the JPEGs metadata is stripped
+// from, as the whole image is kept in memory while it is stripped.
+var MaxStripSize int64 = 32 << 20
+
+// JPEG markers
+const (
+	markerSOI  = 0xd8 // start of image
+	markerSOS  = 0xda // start of scan, followed by the entropy coded data
+	markerAPP1 = 0xe1 // EXIF and XMP metadata
+)
+
+// exifTag is an EXIF field read from images that are stripped. Fields
+// that identify the photographer, their camera or location, such as GPS
+// coordinates and serial numbers, are deliberately left out.
+type exifTag struct {
+	id   uint16
+	name string
+}
+
+var (
+	ifd0Tags = []exifTag{
+		{0x010f, "exif_make"},
+		{0x0110, "exif_model"},
+		{0x0112, "exif_orientation"},
+		{0x0131, "exif_software"},
+		{0x0132, "exif_datetime"},
+	}
+	exifIFDTags = []exifTag{
+		{0x829a, "exif_exposure_time"},
+		{0x829d, "exif_f_number"},
+		{0x8827, "exif_iso"},
+		{0x9003, "exif_datetime_original"},
+		{0x920a, "exif_focal_length"},
+		{0xa434, "exif_lens_model"},
+	}
+)
+
+// exifIFDPointer is the tag of the offset of the EXIF sub-IFD in IFD0
+const exifIFDPointer = 0x8769
+
+// StripJPEG returns the JPEG data without its APP1 segments, which hold the
+// EXIF and XMP metadata including camera serials and GPS coordinates, and
+// the fields of ifd0Tags and exifIFDTags read from the EXIF. Images are
+// rotated and flipped as their EXIF orientation says, as viewers can no
+// longer do so, which means re-encoding them. Otherwise the image data is
+// untouched.
+func StripJPEG(data []byte) ([]byte, map[string]string, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, nil, ErrBadJPEG
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	var fields map[string]string
+	i := 2
+	for {
+		// Markers may be preceded by any number of fill bytes
+		for i < len(data) && data[i] == 0xff && i+1 < len(data) && data[i+1] == 0xff {
+			i++
+		}
+		if i+4 > len(data) || data[i] != 0xff {
+			return nil, nil, ErrBadJPEG
+		}
+		marker := data[i+1]
+		if marker == markerSOS {
+			out.Write(data[i:])
+			break
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			// Standalone markers without a length
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, nil, ErrBadJPEG
+		}
+		segment := data[i:end]
+		i = end
+		if marker != markerAPP1 {
+			out.Write(segment)
+			continue
+		}
+		if fields == nil && bytes.HasPrefix(segment[4:], []byte("Exif\x00\x00")) {
+			fields = parseEXIF(segment[10:])
+		}
+	}
+	stripped := out.Bytes()
+	// The orientation is applied rather than returned, so the fields
+	// describe the stripped image
+	if o, ok := fields["exif_orientation"]; ok {
+		delete(fields, "exif_orientation")
+		n, _ := strconv.Atoi(o)
+		rotated, err := orientJPEG(stripped, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		stripped = rotated
+	}
+	return stripped, fields, nil
+}
+
+// parseEXIF reads the fields of ifd0Tags and exifIFDTags from the TIFF
+// structure of an EXIF segment. Fields that cannot be read are left out.
+func parseEXIF(tiff []byte) map[string]string {
+	fields := map[string]string{}
+	if len(tiff) < 8 {
+		return fields
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return fields
+	}
+	ifd0 := order.Uint32(tiff[4:])
+	entries := readIFD(tiff, order, ifd0)
+	for _, tag := range ifd0Tags {
+		if v, ok := exifValue(tiff, order, entries[tag.id]); ok {
+			fields[tag.name] = v
+		}
+	}
+	if e, ok := entries[exifIFDPointer]; ok {
+		sub := readIFD(tiff, order, order.Uint32(e[8:]))
+		for _, tag := range exifIFDTags {
+			if v, ok := exifValue(tiff, order, sub[tag.id]); ok {
+				fields[tag.name] = v
+			}
+		}
+	}
+	return fields
+}
+
+// readIFD returns the 12 byte entries of the IFD at off by tag
+func readIFD(tiff []byte, order binary.ByteOrder, off uint32) map[uint16][]byte {
+	entries := map[uint16][]byte{}
+	if uint64(off)+2 > uint64(len(tiff)) {
+		return entries
+	}
+	n := int(order.Uint16(tiff[off:]))
+	p := int(off) + 2
+	for j := 0; j < n && p+12 <= len(tiff); j++ {
+		entries[order.Uint16(tiff[p:])] = tiff[p : p+12]
+		p += 12
+	}
+	return entries
+}
+
+// exifValue formats the value of an IFD entry of ASCII, SHORT, LONG or
+// RATIONAL type
+func exifValue(tiff []byte, order binary.ByteOrder, e []byte) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	typ, count := order.Uint16(e[2:]), order.Uint32(e[4:])
+	sizes := map[uint16]uint32{2: 1, 3: 2, 4: 4, 5: 8}
+	size, ok := sizes[typ]
+	if !ok || count == 0 || count > 1<<16 {
+		return "", false
+	}
+	value := e[8:12]
+	if size*count > 4 {
+		off := order.Uint32(e[8:])
+		if uint64(off)+uint64(size*count) > uint64(len(tiff)) {
+			return "", false
+		}
+		value = tiff[off : off+size*count]
+	}
+	switch typ {
+	case 2:
+		s := strings.TrimSpace(strings.TrimRight(string(value[:count]), "\x00"))
+		return s, s != ""
+	case 3:
+		return strconv.Itoa(int(order.Uint16(value))), true
+	case 4:
+		return strconv.FormatUint(uint64(order.Uint32(value)), 10), true
+	}
+	num, den := order.Uint32(value), order.Uint32(value[4:])
+	if den == 0 {
+		return "", false
+	}
+	if num == 1 && den > 1 {
+		return fmt.Sprintf("1/%d", den), true
+	}
+	return strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64), true
+}
+
+// orientJPEG re-encodes the JPEG data transformed by an EXIF orientation
+func orientJPEG(data []byte, orientation int) ([]byte, error) {
+	if orientation < 2 || orientation > 8 {
+		return data, nil
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadJPEG
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+	resizing <- struct{}{}
+	defer func() { <-resizing }()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadJPEG
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, orient(img, orientation), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// orient returns img rotated and flipped so that an image with the EXIF
+// orientation is upright
+func orient(img image.Image, orientation int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror
+				dx, dy = w-1-x, y
+			case 3: // rotate 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90° counter clockwise
+				dx, dy = y, w-1-x
+			}
+			i, j := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[j:j+4], src.Pix[i:i+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,127 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// exifJPEG returns a 16x8 JPEG with a red left half and blue right half,
+// and the same JPEG with EXIF and XMP segments added
+func exifJPEG(t *testing.T, orientation uint16) (plain, tagged []byte) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 8 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	plain = buf.Bytes()
+	// IFD0 at 8 with 4 entries, the EXIF IFD at 62 with 3 entries and
+	// the values that do not fit in the entries at 104
+	tiff := new(bytes.Buffer)
+	be := binary.BigEndian
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(tiff, be, uint32(8))
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(tiff, be, tag)
+		binary.Write(tiff, be, typ)
+		binary.Write(tiff, be, count)
+		binary.Write(tiff, be, value)
+	}
+	binary.Write(tiff, be, uint16(4))
+	entry(0x010f, 2, 10, 104)
+	entry(0x0112, 3, 1, uint32(orientation)<<16)
+	entry(0x8769, 4, 1, 62)
+	entry(0x8825, 4, 1, 0) // GPS IFD, never read
+	binary.Write(tiff, be, uint32(0))
+	binary.Write(tiff, be, uint16(3))
+	entry(0x829a, 5, 1, 114)
+	entry(0x829d, 5, 1, 122)
+	entry(0x8827, 3, 1, 200<<16)
+	binary.Write(tiff, be, uint32(0))
+	tiff.WriteString("Canon EOS\x00")
+	binary.Write(tiff, be, []uint32{1, 125, 28, 10})
+
+	segment := func(content []byte) []byte {
+		s := []byte{0xff, markerAPP1, 0, 0}
+		be.PutUint16(s[2:], uint16(2+len(content)))
+		return append(s, content...)
+	}
+	tagged = append([]byte{}, plain[:2]...)
+	tagged = append(tagged, segment(append([]byte("Exif\x00\x00"), tiff.Bytes()...))...)
+	tagged = append(tagged, segment([]byte("http://ns.adobe.com/xap/1.0/\x00<exif:GPSLatitude>51,30N</exif:GPSLatitude>"))...)
+	tagged = append(tagged, plain[2:]...)
+	return plain, tagged
+}
+
+func TestStripJPEG(t *testing.T) {
+	plain, tagged := exifJPEG(t, 1)
+	stripped, fields, err := StripJPEG(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, plain) {
+		t.Error("expected only the APP1 segments to be removed")
+	}
+	exp := map[string]string{
+		"exif_make":          "Canon EOS",
+		"exif_exposure_time": "1/125",
+		"exif_f_number":      "2.8",
+		"exif_iso":           "200",
+	}
+	if len(fields) != len(exp) {
+		t.Errorf("expected fields %v got: %v", exp, fields)
+	}
+	for k, v := range exp {
+		if fields[k] != v {
+			t.Errorf("expected fields %v got: %v", exp, fields)
+			break
+		}
+	}
+	if stripped, _, err := StripJPEG(plain); err != nil || !bytes.Equal(stripped, plain) {
+		t.Errorf("expected JPEG without EXIF to be unchanged: %v", err)
+	}
+
+	// Rotated 90° so the red half is on top
+	_, tagged = exifJPEG(t, 6)
+	stripped, fields, err = StripJPEG(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["exif_orientation"]; ok {
+		t.Errorf("expected orientation to be applied not stored got: %v", fields)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 8 || img.Bounds().Dy() != 16 {
+		t.Fatalf("expected 8x16 image got: %v", img.Bounds())
+	}
+	if r, _, b, _ := img.At(4, 2).RGBA(); r>>8 < 200 || b>>8 > 50 {
+		t.Errorf("expected red top got: %v", img.At(4, 2))
+	}
+	if r, _, b, _ := img.At(4, 13).RGBA(); r>>8 > 50 || b>>8 < 200 {
+		t.Errorf("expected blue bottom got: %v", img.At(4, 13))
+	}
+	if bytes.Contains(stripped, []byte("Exif")) || bytes.Contains(stripped, []byte("GPS")) {
+		t.Error("expected metadata to be stripped")
+	}
+
+	for _, data := range [][]byte{[]byte("not a jpeg"), tagged[:30], plain[:2]} {
+		if _, _, err := StripJPEG(data); err != ErrBadJPEG {
+			t.Errorf("expected ErrBadJPEG got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package blob
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		store := NewStore(NewMemoryBackend())
+		if indexed {
+			store.SetIndex(NewIndex())
+		}
+		past := time.Now().Add(-time.Minute)
+		future := time.Now().Add(time.Hour)
+		expired := store.New()
+		expired.ExpiresAt = &past
+		live := store.New()
+		live.ExpiresAt = &future
+		forever := store.New()
+		for _, b := range []*Blob{expired, live, forever} {
+			if err := b.WriteFrom(strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := expired.File(); err != ErrExpired {
+			t.Fatalf("expected ErrExpired reading expired blob got: %v", err)
+		}
+		if indexed {
+			if blobs, _, _ := store.List(Query{}); len(blobs) != 2 {
+				t.Fatalf("expected expired blob to be excluded from listing got: %d blobs", len(blobs))
+			}
+		}
+		ids, err := store.Reap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != expired.ID {
+			t.Fatalf("expected only the expired blob to be reaped got: %v", ids)
+		}
+		if _, err := store.Get(expired.ID); err != ErrNotFound {
+			t.Fatalf("expected reaped blob to be gone got: %v", err)
+		}
+		for _, b := range []*Blob{live, forever} {
+			if !b.Exists() {
+				t.Fatal("expected unexpired blobs to be kept")
+			}
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"uuid"
+)
+
+// Kinds of problem reported by DiskBackend.Check
+const (
+	ProblemOrphanData     = "orphan data"          // data file without metadata
+	ProblemOrphanMeta     = "orphan metadata"      // metadata without a data file
+	ProblemSizeMismatch   = "size mismatch"        // data file size differs from Blob.Size
+	ProblemBadMeta        = "invalid metadata"     // metadata that cannot be parsed
+	ProblemBadName        = "invalid name"         // file not named after a blob UUID
+	ProblemWrongDir       = "wrong directory"      // file not in the directory for its UUID
+	ProblemTempFile       = "temporary file"       // left behind by an interrupted write
+	ProblemTombstone      = "interrupted delete"   // metadata tombstone left by an interrupted Delete
+	ProblemUnreferenced   = "unreferenced content" // deduplicated content no blob links to
+	ProblemOrphanVariants = "orphan variants"      // cached variants of a blob that no longer exists
+)
+
+// Files that Check cannot repair in place are moved to /<Dir>/quarantine
+// keeping their path relative to the state dir.
+const quarantineDir = "quarantine"
+
+// reservedDir reports whether name is a directory in the root of the state
+// dir that does not hold blobs
+func reservedDir(name string) bool {
+	return name == contentDir || name == quarantineDir
+}
+
+// RepairMode controls how DiskBackend.Check repairs the problems it finds
+type RepairMode int
+
+const (
+	RepairNone       RepairMode = iota // Only report problems
+	RepairQuarantine                   // Move misplaced files and quarantine anything else
+	RepairRegenerate                   // As RepairQuarantine but regenerate metadata from the data where possible
+)
+
+// Problem is an inconsistency found in the state dir
+type Problem struct {
+	Kind   string // One of the Problem* kinds
+	Path   string // Path of the file relative to the state dir
+	Detail string // Further description of the problem
+	Repair string // Action taken to repair the problem, empty if not repaired
+}
+
+func (p *Problem) String() string {
+	s := p.Kind + ": " + p.Path
+	if p.Detail != "" {
+		s += " (" + p.Detail + ")"
+	}
+	if p.Repair != "" {
+		s += ": " + p.Repair
+	}
+	return s
+}
+
+// checker holds the state of a DiskBackend.Check
+type checker struct {
+	d      *DiskBackend
+	mode   RepairMode
+	report func(*Problem)
+}
+
+// Check walks the state dir looking for data files without metadata,
+// metadata without data, size mismatches, files that are not named after a
+// blob UUID or that are in the wrong directory, and debris from interrupted
+// writes and deletes, including variants left behind by deleted blobs. Each
+// problem is passed to fn after any repair has been attempted. Check must
+// not run while the state dir is in use.
+func (d *DiskBackend) Check(mode RepairMode, fn func(*Problem)) error {
+	c := &checker{d: d, mode: mode, report: fn}
+	// Misplaced files are moved first so both halves of a blob are checked
+	// together afterwards
+	if err := c.eachFile(c.checkPlacement); err != nil {
+		return err
+	}
+	if err := c.eachFile(c.checkFile); err != nil {
+		return err
+	}
+	if err := c.checkVariants(); err != nil {
+		return err
+	}
+	return c.checkContent()
+}
+
+// blobFiles returns the sorted paths of all files in the blob directories of
+// the state dir. Files in the root, such as the index, and variants are
+// skipped.
+func (d *DiskBackend) blobFiles() ([]string, error) {
+	paths, _, err := d.walkBlobDirs()
+	return paths, err
+}
+
+// walkBlobDirs returns the sorted paths of all files in the blob directories
+// of the state dir and of the directories of variants within them
+func (d *DiskBackend) walkBlobDirs() (files, variants []string, err error) {
+	root := filepath.Clean(d.Dir)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && filepath.Dir(path) == root {
+			if fi.IsDir() && reservedDir(fi.Name()) {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+		}
+		if fi.IsDir() && strings.HasSuffix(fi.Name(), variantsExt) {
+			variants = append(variants, path)
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	sort.Strings(variants)
+	return files, variants, err
+}
+
+// eachFile calls fn for each file in the blob directories that still exists
+func (c *checker) eachFile(fn func(path string) error) error {
+	paths, err := c.d.blobFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue // moved or removed by an earlier repair
+		}
+		if err := fn(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// problem reports a problem with the file at path
+func (c *checker) problem(kind, path, detail, repair string) {
+	rel, err := filepath.Rel(c.d.Dir, path)
+	if err != nil {
+		rel = path
+	}
+	c.report(&Problem{Kind: kind, Path: rel, Detail: detail, Repair: repair})
+}
+
+// blobID returns the id of the blob a file in a blob directory belongs to.
+// Only the data, metadata and tombstone names written by the backend are
+// accepted.
+func blobID(name string) (uuid.UUID, error) {
+	for _, ext := range []string{".json.deleted", ".json"} {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	id, err := uuid.ParseUUID(name)
+	if err != nil {
+		return id, err
+	}
+	if !id.Valid() || id.String() != name {
+		return id, fmt.Errorf("invalid blob id %q", name)
+	}
+	return id, nil
+}
+
+// quarantine moves the files at paths into the quarantine dir
+func (c *checker) quarantine(paths ...string) (string, error) {
+	for _, path := range paths {
+		rel, err := filepath.Rel(c.d.Dir, path)
+		if err != nil {
+			return "", err
+		}
+		dst := filepath.Join(c.d.Dir, quarantineDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return "", err
+		}
+		if err := os.Rename(path, dst); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "quarantined", nil
+}
+
+// checkPlacement moves files that are not in the directory for their UUID
+func (c *checker) checkPlacement(path string) error {
+	name := filepath.Base(path)
+	id, err := blobID(name)
+	if err != nil || strings.HasPrefix(name, ".") {
+		return nil // reported by checkFile
+	}
+	dirs, err := c.d.dirs(id)
+	if err != nil {
+		return err
+	}
+	if containsString(dirs, filepath.Dir(path)) {
+		return nil // blobs in other layouts are moved by MigrateLayout
+	}
+	dir := dirs[0]
+	rel, _ := filepath.Rel(c.d.Dir, dir)
+	detail := "belongs in " + rel
+	if c.mode == RepairNone {
+		c.problem(ProblemWrongDir, path, detail, "")
+		return nil
+	}
+	dst := filepath.Join(dir, name)
+	var repair string
+	if _, err := os.Lstat(dst); err == nil {
+		// Never overwrite, the copy in the right place takes precedence
+		if repair, err = c.quarantine(path); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		if err := os.Rename(path, dst); err != nil {
+			return err
+		}
+		repair = "moved"
+	}
+	c.problem(ProblemWrongDir, path, detail, repair)
+	return nil
+}
+
+// checkFile checks a single file in a blob directory
+func (c *checker) checkFile(path string) error {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return c.unrepairable(ProblemTempFile, path, "")
+	}
+	id, err := blobID(name)
+	if err != nil {
+		return c.unrepairable(ProblemBadName, path, "")
+	}
+	switch {
+	case strings.HasSuffix(name, ".json.deleted"):
+		return c.checkTombstone(strings.TrimSuffix(path, ".json.deleted"), path)
+	case strings.HasSuffix(name, ".json"):
+		return c.checkMeta(id, path)
+	}
+	metaPath, err := c.d.find(id, ".json")
+	if err != nil {
+		return err
+	}
+	if exists(path+".json") || exists(path+".json.deleted") || exists(metaPath) {
+		return nil // checked along with the metadata
+	}
+	if c.mode == RepairRegenerate {
+		return c.regenerate(ProblemOrphanData, id, path, "", nil)
+	}
+	return c.unrepairable(ProblemOrphanData, path, "")
+}
+
+// unrepairable reports a problem that can only be repaired by quarantine
+func (c *checker) unrepairable(kind, path, detail string, extra ...string) error {
+	var repair string
+	if c.mode != RepairNone {
+		var err error
+		if repair, err = c.quarantine(append([]string{path}, extra...)...); err != nil {
+			return err
+		}
+	}
+	c.problem(kind, path, detail, repair)
+	return nil
+}
+
+// checkTombstone finishes a Delete that was interrupted after the metadata
+// was renamed to the tombstone
+func (c *checker) checkTombstone(dataPath, tombstone string) error {
+	var repair string
+	if c.mode != RepairNone {
+		if err := c.d.removeData(dataPath, tombstone); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(dataPath + variantsExt); err != nil {
+			return err
+		}
+		if err := os.Remove(tombstone); err != nil {
+			return err
+		}
+		repair = "deleted"
+	}
+	c.problem(ProblemTombstone, tombstone, "", repair)
+	return nil
+}
+
+// checkMeta checks the metadata at metaPath against the blob data, which
+// may be in the directory of another layout
+func (c *checker) checkMeta(id uuid.UUID, metaPath string) error {
+	b := &Blob{}
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return err
+	}
+	dataPath := strings.TrimSuffix(metaPath, ".json")
+	if !exists(dataPath) {
+		if dataPath, err = c.d.find(id, ""); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(data, b); err != nil || b.ID != id {
+		detail := "id does not match filename"
+		if err != nil {
+			detail = err.Error()
+		}
+		if c.mode == RepairRegenerate && exists(dataPath) {
+			return c.regenerate(ProblemBadMeta, id, dataPath, detail, nil)
+		}
+		return c.unrepairable(ProblemBadMeta, metaPath, detail, dataPath)
+	}
+	fi, err := os.Stat(dataPath)
+	if os.IsNotExist(err) {
+		return c.unrepairable(ProblemOrphanMeta, metaPath, "")
+	} else if err != nil {
+		return err
+	}
+	if fi.Size() == b.Size {
+		return nil
+	}
+	detail := fmt.Sprintf("metadata has %d bytes, data has %d", b.Size, fi.Size())
+	if c.mode == RepairRegenerate {
+		return c.regenerate(ProblemSizeMismatch, id, dataPath, detail, b)
+	}
+	return c.unrepairable(ProblemSizeMismatch, dataPath, detail, metaPath)
+}
+
+// regenerate rewrites the metadata for the data at path, keeping the name,
+// content type and meta of old if given. The metadata is written next to
+// the data, whichever layout it is in.
+func (c *checker) regenerate(kind string, id uuid.UUID, path, detail string, old *Blob) error {
+	b := &Blob{ID: id}
+	if old != nil {
+		b.Name, b.ContentType, b.Meta = old.Name, old.ContentType, old.Meta
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if b.ContentType == "" {
+		b.ContentType = http.DetectContentType(head[:n])
+	}
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	h := io.MultiWriter(sha256Hash, md5Hash)
+	h.Write(head[:n])
+	rest, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	b.Size = int64(n) + rest
+	b.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	b.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if _, err := writeFileAtomic(path+".json", bytes.NewReader(append(data, '\n'))); err != nil {
+		return err
+	}
+	dirs, err := c.d.dirs(id)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if dir == filepath.Dir(path) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, id.String()+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	c.problem(kind, path, detail, "regenerated metadata")
+	return nil
+}
+
+// checkVariants looks for directories of variants that do not belong to a
+// blob, which are removed as they can always be generated again
+func (c *checker) checkVariants() error {
+	_, dirs, err := c.d.walkBlobDirs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		id, err := blobID(strings.TrimSuffix(filepath.Base(dir), variantsExt))
+		if err == nil {
+			metaPath, err := c.d.find(id, ".json")
+			if err != nil {
+				return err
+			}
+			if exists(metaPath) {
+				continue
+			}
+		}
+		var repair string
+		if c.mode != RepairNone {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			repair = "deleted"
+		}
+		c.problem(ProblemOrphanVariants, dir, "", repair)
+	}
+	return nil
+}
+
+// checkContent looks for deduplicated content that no blob links to
+func (c *checker) checkContent() error {
+	root := filepath.Join(c.d.Dir, contentDir)
+	var paths []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if filepath.Dir(path) == root {
+			if err := c.unrepairable(ProblemTempFile, path, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if n, ok := linkCount(fi); ok && n == 1 {
+			if err := c.unrepairable(ProblemUnreferenced, path, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exists reports whether a file exists at path
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,142 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk := NewDiskBackend(dir)
+	store := NewStore(disk)
+	write := func(name string) (*Blob, string) {
+		b := indexedBlob(t, store, time.Now(), name, "text/plain", name, nil)
+		path, err := b.Path()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, path
+	}
+	good, goodPath := write("good.txt")
+	if err := disk.PutVariant(good.ID, "w10-h10-contain.png", strings.NewReader("variant")); err != nil {
+		t.Fatal(err)
+	}
+	orphanVariants := filepath.Join(filepath.Dir(goodPath), store.New().ID.String()+variantsExt)
+	os.MkdirAll(orphanVariants, 0777)
+	ioutil.WriteFile(filepath.Join(orphanVariants, "w10-h10-contain.png"), nil, 0644)
+	_, orphanData := write("orphan-data.txt")
+	os.Remove(orphanData + ".json")
+	_, orphanMeta := write("orphan-meta.txt")
+	os.Remove(orphanMeta)
+	mismatch, mismatchPath := write("mismatch.txt")
+	ioutil.WriteFile(mismatchPath, []byte("longer than before"), 0644)
+	badMeta, badMetaPath := write("bad-meta.txt")
+	ioutil.WriteFile(badMetaPath+".json", []byte("{"), 0644)
+	_, tombstone := write("tombstone.txt")
+	os.Rename(tombstone+".json", tombstone+".json.deleted")
+	misplaced, misplacedPath := write("misplaced.txt")
+	wrongDir := filepath.Join(dir, "2001", "01", "01")
+	os.MkdirAll(wrongDir, 0777)
+	os.Rename(misplacedPath, filepath.Join(wrongDir, misplaced.ID.String()))
+	os.Rename(misplacedPath+".json", filepath.Join(wrongDir, misplaced.ID.String()+".json"))
+	ioutil.WriteFile(filepath.Join(wrongDir, "not-a-blob"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(wrongDir, ".tmp123"), nil, 0644)
+	unreferenced := filepath.Join(dir, contentDir, "ab", "cd", "abcd")
+	os.MkdirAll(filepath.Dir(unreferenced), 0777)
+	ioutil.WriteFile(unreferenced, nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "index.log"), nil, 0644)
+
+	check := func(mode RepairMode) map[string]int {
+		found := map[string]int{}
+		err := disk.Check(mode, func(p *Problem) {
+			found[p.Kind]++
+			if mode != RepairNone && p.Repair == "" {
+				t.Errorf("expected %s to be repaired", p)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	exp := map[string]int{
+		ProblemOrphanData:     1,
+		ProblemOrphanMeta:     1,
+		ProblemSizeMismatch:   1,
+		ProblemBadMeta:        1,
+		ProblemTombstone:      1,
+		ProblemWrongDir:       2,
+		ProblemBadName:        1,
+		ProblemTempFile:       1,
+		ProblemUnreferenced:   1,
+		ProblemOrphanVariants: 1,
+	}
+	for _, mode := range []RepairMode{RepairNone, RepairRegenerate} {
+		found := check(mode)
+		for kind, n := range exp {
+			if found[kind] != n {
+				t.Errorf("expected %d %s problems got: %d", n, kind, found[kind])
+			}
+		}
+	}
+	if found := check(RepairNone); len(found) != 0 {
+		t.Fatalf("expected no problems after repair got: %v", found)
+	}
+	for _, b := range []*Blob{good, misplaced, mismatch, badMeta} {
+		got, err := store.Get(b.ID)
+		if err != nil {
+			t.Fatalf("expected %s to be readable after repair: %v", b.Name, err)
+		}
+		if size, _ := disk.Stat(b.ID); got.Size != size {
+			t.Errorf("expected %s size %d got: %d", b.Name, size, got.Size)
+		}
+	}
+	if got, _ := store.Get(mismatch.ID); got.Name != "mismatch.txt" || got.SHA256 == mismatch.SHA256 {
+		t.Errorf("expected regenerated metadata to keep the name and update checksums got: %+v", got)
+	}
+	rel, _ := filepath.Rel(dir, orphanMeta+".json")
+	if !exists(filepath.Join(dir, quarantineDir, rel)) {
+		t.Error("expected orphan metadata to be quarantined")
+	}
+	if exists(orphanVariants) || !exists(goodPath+variantsExt) {
+		t.Error("expected only the orphan variants to be deleted")
+	}
+	if !exists(filepath.Join(dir, "index.log")) {
+		t.Error("expected files in the state dir root to be left alone")
+	}
+}
+
+func TestCheckRegenerateInLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hashed := NewDiskBackend(dir)
+	hashed.Layout = HashLayout
+	b := indexedBlob(t, NewStore(hashed), time.Now(), "a.txt", "text/plain", "data", nil)
+	path, err := b.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".json")
+	// Checked without knowing the layout new blobs are written in
+	disk := NewDiskBackend(dir)
+	if err := disk.Check(RepairRegenerate, func(*Problem) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(path + ".json") {
+		t.Fatal("expected metadata to be regenerated next to the data")
+	}
+	if found, _ := disk.blobFiles(); len(found) != 2 {
+		t.Fatalf("expected only the data and metadata files got: %v", found)
+	}
+}
@@ -0,0 +1,486 @@
+package blob
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"uuid"
+)
+
+// ErrNoIndex is returned when listing blobs from a store without an Index
+var ErrNoIndex = errors.New("blob store has no index")
+
+// Index keeps the metadata of every blob in a store in memory, ordered by
+// creation time, so that blobs can be listed and queried without walking
+// the backend. An Index opened from a file journals every change to it so
+// that it survives restarts. It can always be rebuilt from the backend.
+type Index struct {
+	mu      sync.RWMutex
+	blobs   map[uuid.UUID]*Blob
+	order   []*Blob // sorted by time then ID
+	path    string
+	journal *os.File
+	records int // records in the journal
+}
+
+// The journal is compacted once it holds more than compactRatio records for
+// each indexed blob, and at least compactMinRecords, so that updates to the
+// same blobs do not grow it without bound
+const (
+	compactRatio      = 2
+	compactMinRecords = 1024
+)
+
+// indexRecord is a single journal entry
+type indexRecord struct {
+	Put    *Blob      `json:"put,omitempty"`
+	Delete *uuid.UUID `json:"delete,omitempty"`
+}
+
+// NewIndex returns an empty in-memory *Index
+func NewIndex() *Index {
+	return &Index{
+		blobs: map[uuid.UUID]*Blob{},
+	}
+}
+
+// OpenIndex loads the index journal at path, creating it if missing.
+// The journal is compacted on open and whenever it grows too large.
+func OpenIndex(path string) (*Index, error) {
+	idx := NewIndex()
+	idx.path = path
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			var rec indexRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// a torn final write is ignored, the index can be rebuilt
+				continue
+			}
+			idx.apply(rec)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := idx.compact(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// IndexExists reports whether an index journal exists at path
+func IndexExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compact rewrites the journal with one record per indexed blob.
+// Must be called with the lock held or before the index is shared.
+func (idx *Index) compact() error {
+	if idx.path == "" {
+		return nil
+	}
+	if idx.journal != nil {
+		idx.journal.Close()
+		idx.journal = nil
+	}
+	tmp, _, err := writeTemp(filepath.Dir(idx.path), "."+filepath.Base(idx.path)+".tmp", &indexSnapshot{blobs: idx.order})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, idx.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	idx.records = len(idx.order)
+	idx.journal, err = os.OpenFile(idx.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// indexSnapshot is a reader of a journal containing a put for each blob
+type indexSnapshot struct {
+	blobs []*Blob
+	buf   []byte
+}
+
+func (s *indexSnapshot) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if len(s.blobs) == 0 {
+			return 0, io.EOF
+		}
+		line, err := json.Marshal(indexRecord{Put: s.blobs[0]})
+		if err != nil {
+			return 0, err
+		}
+		s.buf = append(line, '\n')
+		s.blobs = s.blobs[1:]
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// write appends rec to the journal, compacting it when it has grown too
+// large. Must be called with the lock held.
+func (idx *Index) write(rec indexRecord) error {
+	if idx.journal == nil {
+		return nil
+	}
+	if idx.records >= compactMinRecords && idx.records >= compactRatio*len(idx.order) {
+		// rec is already applied so the snapshot includes it
+		return idx.compact()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = idx.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	idx.records++
+	return nil
+}
+
+// less orders blobs by creation time then ID
+func less(a, b *Blob) bool {
+	ta, tb := a.Time(), b.Time()
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return a.ID.String() < b.ID.String()
+}
+
+// search returns the position of the first blob not ordered before b
+func (idx *Index) search(b *Blob) int {
+	return sort.Search(len(idx.order), func(i int) bool {
+		return !less(idx.order[i], b)
+	})
+}
+
+// apply updates the in-memory state. Must be called with the lock held.
+func (idx *Index) apply(rec indexRecord) {
+	switch {
+	case rec.Put != nil:
+		b := rec.Put
+		if _, ok := idx.blobs[b.ID]; ok {
+			idx.order[idx.search(b)] = b
+		} else {
+			i := idx.search(b)
+			idx.order = append(idx.order, nil)
+			copy(idx.order[i+1:], idx.order[i:])
+			idx.order[i] = b
+		}
+		idx.blobs[b.ID] = b
+	case rec.Delete != nil:
+		b, ok := idx.blobs[*rec.Delete]
+		if !ok {
+			return
+		}
+		i := idx.search(b)
+		idx.order = append(idx.order[:i], idx.order[i+1:]...)
+		delete(idx.blobs, b.ID)
+	}
+}
+
+// clone returns a copy of b that shares no state with it
+func clone(b *Blob) *Blob {
+	cp := *b
+	cp.store = nil
+	if b.Meta != nil {
+		cp.Meta = make(map[string]string, len(b.Meta))
+		for k, v := range b.Meta {
+			cp.Meta[k] = v
+		}
+	}
+	if b.Renditions != nil {
+		cp.Renditions = make(map[string]Rendition, len(b.Renditions))
+		for k, v := range b.Renditions {
+			cp.Renditions[k] = v
+		}
+	}
+	return &cp
+}
+
+// Put adds or updates the metadata for b
+func (idx *Index) Put(b *Blob) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	rec := indexRecord{Put: clone(b)}
+	idx.apply(rec)
+	return idx.write(rec)
+}
+
+// Remove drops the blob with id from the index
+func (idx *Index) Remove(id uuid.UUID) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.blobs[id]; !ok {
+		return nil
+	}
+	rec := indexRecord{Delete: &id}
+	idx.apply(rec)
+	return idx.write(rec)
+}
+
+// Len returns the number of indexed blobs
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.order)
+}
+
+// Rebuild replaces the contents of the index with the metadata of every
+// blob in backend. The backend must implement Walker.
+func (idx *Index) Rebuild(backend Backend) error {
+	walker, ok := backend.(Walker)
+	if !ok {
+		return errors.New("blob backend does not support walking blobs")
+	}
+	fresh := NewIndex()
+	err := walker.Walk(func(id uuid.UUID) error {
+		data, err := backend.ReadMeta(id)
+		if err == ErrNotFound {
+			return nil // deleted while walking
+		} else if err != nil {
+			return err
+		}
+		b := &Blob{}
+		if err := json.Unmarshal(data, b); err != nil {
+			return fmt.Errorf("invalid metadata for blob %s: %v", id, err)
+		}
+		fresh.apply(indexRecord{Put: b})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.blobs = fresh.blobs
+	idx.order = fresh.order
+	return idx.compact()
+}
+
+// Close closes the index journal
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.journal == nil {
+		return nil
+	}
+	err := idx.journal.Close()
+	idx.journal = nil
+	return err
+}
+
+// Query selects blobs from an Index. Zero values do not filter.
+type Query struct {
+	ContentType string            // Exact content type, or a prefix ending in "/" such as "image/"
+	NamePrefix  string            // Prefix of the original filename
+	MinSize     int64             // Minimum size in bytes
+	MaxSize     int64             // Maximum size in bytes
+	Since       time.Time         // Created at or after
+	Until       time.Time         // Created before
+	Meta        map[string]string // Meta key/values that must all match
+	After       uuid.UUID         // Cursor, only blobs ordered after this blob are returned
+	Limit       int               // Maximum number of blobs to return, defaults to DefaultQueryLimit
+}
+
+// DefaultQueryLimit is the page size used for queries without a Limit
+const DefaultQueryLimit = 100
+
+// MaxQueryLimit is the largest page size allowed
+const MaxQueryLimit = 1000
+
+// Match reports whether b is selected by the query filters. Expired blobs
+// are never selected.
+func (q *Query) Match(b *Blob) bool {
+	if b.Expired() {
+		return false
+	}
+	if q.ContentType != "" {
+		if strings.HasSuffix(q.ContentType, "/") {
+			if !strings.HasPrefix(b.ContentType, q.ContentType) {
+				return false
+			}
+		} else if b.ContentType != q.ContentType {
+			return false
+		}
+	}
+	if q.NamePrefix != "" && !strings.HasPrefix(b.Name, q.NamePrefix) {
+		return false
+	}
+	if b.Size < q.MinSize || (q.MaxSize > 0 && b.Size > q.MaxSize) {
+		return false
+	}
+	if t := b.Time(); (!q.Since.IsZero() && t.Before(q.Since)) || (!q.Until.IsZero() && !t.Before(q.Until)) {
+		return false
+	}
+	for k, v := range q.Meta {
+		if b.Meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns a page of blobs matching q and the cursor for the next page,
+// which is invalid when there are no more results.
+func (idx *Index) Query(q Query) ([]*Blob, uuid.UUID) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	} else if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	start := 0
+	if q.After.Valid() {
+		cursor := &Blob{ID: q.After}
+		start = idx.search(cursor)
+		if start < len(idx.order) && idx.order[start].ID == q.After {
+			start++
+		}
+	} else if !q.Since.IsZero() {
+		start = sort.Search(len(idx.order), func(i int) bool {
+			return !idx.order[i].Time().Before(q.Since)
+		})
+	}
+	blobs := []*Blob{}
+	for i := start; i < len(idx.order); i++ {
+		b := idx.order[i]
+		if !q.Until.IsZero() && !b.Time().Before(q.Until) {
+			break
+		}
+		if !q.Match(b) {
+			continue
+		}
+		if len(blobs) == limit {
+			return blobs, blobs[len(blobs)-1].ID
+		}
+		blobs = append(blobs, clone(b))
+	}
+	return blobs, uuid.UUID{}
+}
+
+// Expired returns the IDs of the indexed blobs that have expired
+func (idx *Index) Expired() []uuid.UUID {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	ids := []uuid.UUID{}
+	for _, b := range idx.order {
+		if b.Expired() {
+			ids = append(ids, b.ID)
+		}
+	}
+	return ids
+}
+
+// Values encodes the query as URL query parameters
+func (q *Query) Values() url.Values {
+	v := url.Values{}
+	if q.ContentType != "" {
+		v.Set("content_type", q.ContentType)
+	}
+	if q.NamePrefix != "" {
+		v.Set("name", q.NamePrefix)
+	}
+	if q.MinSize > 0 {
+		v.Set("min_size", strconv.FormatInt(q.MinSize, 10))
+	}
+	if q.MaxSize > 0 {
+		v.Set("max_size", strconv.FormatInt(q.MaxSize, 10))
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339Nano))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339Nano))
+	}
+	keys := []string{}
+	for k := range q.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.Add("meta", k+"="+q.Meta[k])
+	}
+	if q.After.Valid() {
+		v.Set("after", q.After.String())
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+// ParseQuery decodes a Query from URL query parameters
+func ParseQuery(v url.Values) (q Query, err error) {
+	q.ContentType = v.Get("content_type")
+	q.NamePrefix = v.Get("name")
+	parseInt := func(name string) int64 {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return 0
+		}
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid %s: %v", name, err)
+		}
+		return n
+	}
+	parseTime := func(name string) time.Time {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			err = fmt.Errorf("invalid %s: %v", name, err)
+		}
+		return t
+	}
+	q.MinSize = parseInt("min_size")
+	q.MaxSize = parseInt("max_size")
+	q.Limit = int(parseInt("limit"))
+	q.Since = parseTime("since")
+	q.Until = parseTime("until")
+	if err != nil {
+		return q, err
+	}
+	for _, kv := range v["meta"] {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return q, fmt.Errorf("invalid meta filter %q, expected key=value", kv)
+		}
+		if q.Meta == nil {
+			q.Meta = map[string]string{}
+		}
+		q.Meta[parts[0]] = parts[1]
+	}
+	if after := v.Get("after"); after != "" {
+		if q.After, err = uuid.ParseUUID(after); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,189 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"uuid"
+)
+
+// indexedBlob writes a blob with the given properties created at t
+func indexedBlob(t *testing.T, store *Store, created time.Time, name, contentType, data string, meta map[string]string) *Blob {
+	b := store.New()
+	b.ID = uuid.UUIDFromTime(created)
+	b.Name = name
+	b.ContentType = contentType
+	b.Meta = meta
+	if err := b.WriteFrom(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestIndexQuery(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	store.SetIndex(NewIndex())
+	base := time.Date(2015, time.September, 1, 0, 0, 0, 0, time.UTC)
+	a := indexedBlob(t, store, base, "a.jpg", "image/jpeg", "aaaa", map[string]string{"album": "x"})
+	b := indexedBlob(t, store, base.Add(time.Hour), "b.png", "image/png", "bb", nil)
+	c := indexedBlob(t, store, base.Add(2*time.Hour), "c.txt", "text/plain", "cccccc", map[string]string{"album": "x"})
+	d := indexedBlob(t, store, base.Add(3*time.Hour), "a2.jpg", "image/jpeg", "d", nil)
+	tests := []struct {
+		q   Query
+		exp []*Blob
+	}{
+		{Query{}, []*Blob{a, b, c, d}},
+		{Query{ContentType: "image/"}, []*Blob{a, b, d}},
+		{Query{ContentType: "image/jpeg"}, []*Blob{a, d}},
+		{Query{NamePrefix: "a"}, []*Blob{a, d}},
+		{Query{MinSize: 2, MaxSize: 4}, []*Blob{a, b}},
+		{Query{Since: base.Add(time.Hour), Until: base.Add(3 * time.Hour)}, []*Blob{b, c}},
+		{Query{Meta: map[string]string{"album": "x"}}, []*Blob{a, c}},
+		{Query{After: b.ID}, []*Blob{c, d}},
+	}
+	for i, test := range tests {
+		blobs, next, err := store.List(test.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Valid() {
+			t.Errorf("%d: expected no next cursor", i)
+		}
+		if len(blobs) != len(test.exp) {
+			t.Fatalf("%d: expected %d blobs got: %d", i, len(test.exp), len(blobs))
+		}
+		for j := range blobs {
+			if blobs[j].ID != test.exp[j].ID {
+				t.Errorf("%d: expected %s at %d got: %s", i, test.exp[j].Name, j, blobs[j].Name)
+			}
+		}
+	}
+	// Pagination
+	seen := []uuid.UUID{}
+	q := Query{Limit: 3}
+	for {
+		blobs, next, err := store.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blobs {
+			seen = append(seen, b.ID)
+		}
+		if !next.Valid() {
+			break
+		}
+		q.After = next
+	}
+	if len(seen) != 4 || seen[3] != d.ID {
+		t.Fatalf("expected to page through all 4 blobs got: %v", seen)
+	}
+	// Deleted blobs are dropped
+	if err := c.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, _, _ := store.List(Query{ContentType: "text/plain"}); len(blobs) != 0 {
+		t.Fatal("expected deleted blob to be removed from index")
+	}
+}
+
+func TestIndexJournalAndRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.log")
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := NewDiskBackend(dir)
+	store := NewStore(backend)
+	store.SetIndex(idx)
+	keep := indexedBlob(t, store, time.Now(), "keep.txt", "text/plain", "keep", nil)
+	gone := indexedBlob(t, store, time.Now(), "gone.txt", "text/plain", "gone", nil)
+	if err := gone.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+	// Reopen from the journal
+	idx, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	blobs, _ := idx.Query(Query{})
+	if len(blobs) != 1 || blobs[0].ID != keep.ID || blobs[0].SHA256 != keep.SHA256 {
+		t.Fatalf("expected journal to contain only the kept blob got: %+v", blobs)
+	}
+	// Rebuild from the state dir
+	idx.Remove(keep.ID)
+	if err := idx.Rebuild(backend); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != 1 {
+		t.Fatalf("expected rebuilt index to contain 1 blob got: %d", idx.Len())
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	q := Query{
+		ContentType: "image/",
+		NamePrefix:  "a",
+		MinSize:     1,
+		MaxSize:     10,
+		Since:       time.Date(2015, time.September, 1, 0, 0, 0, 0, time.UTC),
+		Meta:        map[string]string{"k": "v=1"},
+		After:       uuid.TimeUUID(),
+		Limit:       5,
+	}
+	parsed, err := ParseQuery(q.Values())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ContentType != q.ContentType || parsed.NamePrefix != q.NamePrefix || parsed.MinSize != q.MinSize ||
+		parsed.MaxSize != q.MaxSize || !parsed.Since.Equal(q.Since) || parsed.Meta["k"] != "v=1" ||
+		parsed.After != q.After || parsed.Limit != q.Limit {
+		t.Fatalf("expected parsed query to match\nexp: %+v\ngot: %+v", q, parsed)
+	}
+}
+
+func TestIndexCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.log")
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	b := &Blob{ID: uuid.UUIDFromTime(time.Now()), Name: "a.txt"}
+	for i := 0; i < 3*compactMinRecords; i++ {
+		b.Size = int64(i)
+		if err := idx.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > compactMinRecords {
+		t.Fatalf("expected journal to be compacted got: %d records", lines)
+	}
+	idx.Close()
+	idx, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if blobs, _ := idx.Query(Query{}); len(blobs) != 1 || blobs[0].Size != 3*compactMinRecords-1 {
+		t.Fatalf("expected compacted journal to keep the last update got: %+v", blobs)
+	}
+}
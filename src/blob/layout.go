@@ -0,0 +1,68 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"uuid"
+)
+
+// Layout decides the pideon hole that a blob lives in relative to the root
+// of a backend. Backends write new blobs in their Layout but find existing
+// blobs in any of the known layouts, so a store can be migrated between
+// layouts while it is in use.
+type Layout string
+
+const (
+	// DateLayout stores blobs by creation time in YYYY/MM/DD. It is the
+	// default when no Layout is set.
+	DateLayout Layout = "date"
+	// HashLayout fans blobs out over ab/cd from the SHA-256 of the ID, which
+	// keeps directories small no matter how many blobs arrive in a day.
+	HashLayout Layout = "hash"
+	// legacyLayout is the YYYY/MM/YY layout written by earlier versions that
+	// formatted the day as a two digit year. Blobs are only ever found in it.
+	legacyLayout Layout = "legacy"
+)
+
+// knownLayouts are searched in order for existing blobs
+var knownLayouts = []Layout{DateLayout, HashLayout, legacyLayout}
+
+// Dir returns the slash separated directory of the blob.
+// The UUID is always a v1, so this can be calculated from the UUID alone.
+func (l Layout) Dir(id uuid.UUID) string {
+	switch l {
+	case HashLayout:
+		sum := sha256.Sum256(id.Bytes())
+		h := hex.EncodeToString(sum[:2])
+		return path.Join(h[0:2], h[2:4])
+	case legacyLayout:
+		time := id.Time()
+		return path.Join(time.Format("2006"), time.Format("01"), time.Format("06"))
+	default:
+		time := id.Time()
+		return path.Join(time.Format("2006"), time.Format("01"), time.Format("02"))
+	}
+}
+
+// Path returns the slash separated path of the blob data
+func (l Layout) Path(id uuid.UUID) string {
+	return path.Join(l.Dir(id), id.String())
+}
+
+// searchDirs returns the distinct directories the blob may be found in,
+// starting with the directory of the layout new blobs are written in.
+func (l Layout) searchDirs(id uuid.UUID) []string {
+	dirs := []string{l.Dir(id)}
+	for _, known := range knownLayouts {
+		dir := known.Dir(id)
+		found := false
+		for _, d := range dirs {
+			found = found || d == dir
+		}
+		if !found {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,85 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"uuid"
+)
+
+func TestLayoutDir(t *testing.T) {
+	id := uuid.UUIDFromTime(time.Date(2015, time.September, 1, 12, 0, 0, 0, time.UTC))
+	if dir := DateLayout.Dir(id); dir != "2015/09/01" {
+		t.Errorf("expected date layout dir 2015/09/01 got: %s", dir)
+	}
+	if dir := legacyLayout.Dir(id); dir != "2015/09/15" {
+		t.Errorf("expected legacy layout dir 2015/09/15 got: %s", dir)
+	}
+	if dir := HashLayout.Dir(id); !regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{2}$`).MatchString(dir) {
+		t.Errorf("expected hash layout dir like ab/cd got: %s", dir)
+	}
+	if Layout("").Dir(id) != DateLayout.Dir(id) {
+		t.Error("expected date layout by default")
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk := NewDiskBackend(dir)
+	store := NewStore(disk)
+	// Written by earlier versions in the legacy layout
+	disk.Layout = legacyLayout
+	created := time.Date(2015, time.September, 1, 12, 0, 0, 0, time.UTC)
+	old := indexedBlob(t, store, created, "old.txt", "text/plain", "old", nil)
+	gone := indexedBlob(t, store, created.Add(time.Hour), "gone.txt", "text/plain", "gone", nil)
+	disk.Layout = DateLayout
+	current := indexedBlob(t, store, created.Add(2*time.Hour), "current.txt", "text/plain", "current", nil)
+	// Found in either layout
+	disk.Layout = HashLayout
+	for _, b := range []*Blob{old, current} {
+		got, err := store.Get(b.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := got.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != strings.TrimSuffix(b.Name, ".txt") {
+			t.Fatalf("expected to read %s got: %q", b.Name, data)
+		}
+	}
+	if err := gone.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	if err := disk.MigrateLayout(func(id uuid.UUID) { moved++ }); err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Fatalf("expected 2 blobs moved got: %d", moved)
+	}
+	for _, b := range []*Blob{old, current} {
+		path, err := b.Path()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := filepath.Join(dir, filepath.FromSlash(HashLayout.Path(b.ID)))
+		if path != exp || !exists(path+".json") {
+			t.Errorf("expected %s to be moved to %s got: %s", b.Name, exp, path)
+		}
+	}
+	if exists(filepath.Join(dir, "2015")) {
+		t.Error("expected empty date directories to be removed")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package blob
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links to the file
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
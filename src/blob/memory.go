@@ -0,0 +1,157 @@
+package blob
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"uuid"
+)
+
+// MemoryBackend keeps blobs in memory. It is mostly useful for testing.
+type MemoryBackend struct {
+	mu       sync.RWMutex
+	data     map[uuid.UUID][]byte
+	meta     map[uuid.UUID][]byte
+	variants map[uuid.UUID]map[string][]byte
+}
+
+// NewMemoryBackend returns an empty *MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		data:     map[uuid.UUID][]byte{},
+		meta:     map[uuid.UUID][]byte{},
+		variants: map[uuid.UUID]map[string][]byte{},
+	}
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (f memoryFile) Close() error {
+	return nil
+}
+
+// Put reads all of src into memory
+func (m *MemoryBackend) Put(id uuid.UUID, src io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[id] = data
+	return int64(len(data)), nil
+}
+
+// Open returns a File reading from the in-memory data
+func (m *MemoryBackend) Open(id uuid.UUID) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.data[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return memoryFile{bytes.NewReader(data)}, nil
+}
+
+// Stat returns the size of the in-memory data
+func (m *MemoryBackend) Stat(id uuid.UUID) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.data[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return int64(len(data)), nil
+}
+
+// Delete forgets the data, metadata and variants
+func (m *MemoryBackend) Delete(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.meta[id]
+	delete(m.data, id)
+	delete(m.meta, id)
+	delete(m.variants, id)
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PutVariant reads all of src into memory as a variant of the blob data
+func (m *MemoryBackend) PutVariant(id uuid.UUID, name string, src io.Reader) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[id]; !ok {
+		return ErrNotFound
+	}
+	if m.variants[id] == nil {
+		m.variants[id] = map[string][]byte{}
+	}
+	m.variants[id][name] = data
+	return nil
+}
+
+// OpenVariant returns a File reading from the in-memory variant data
+func (m *MemoryBackend) OpenVariant(id uuid.UUID, name string) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.variants[id][name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return memoryFile{bytes.NewReader(data)}, nil
+}
+
+// DeleteVariant removes the in-memory variant data
+func (m *MemoryBackend) DeleteVariant(id uuid.UUID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.variants[id][name]; !ok {
+		return ErrNotFound
+	}
+	delete(m.variants[id], name)
+	return nil
+}
+
+// ReadMeta returns a copy of the stored metadata
+func (m *MemoryBackend) ReadMeta(id uuid.UUID) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.meta[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// WriteMeta stores a copy of the metadata
+func (m *MemoryBackend) WriteMeta(id uuid.UUID, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.meta[id] = append([]byte(nil), data...)
+	return nil
+}
+
+// Walk calls fn for each stored blob
+func (m *MemoryBackend) Walk(fn func(id uuid.UUID) error) error {
+	m.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(m.meta))
+	for id := range m.meta {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package blob
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"uuid"
+)
+
+// MigrateLayout moves blobs stored in the directories of other layouts into
+// the directories of the backend Layout, calling fn with the ID of each blob
+// moved. Blobs can be found in either directory throughout, so the backend
+// may be in use while it is migrated. Directories left empty are removed.
+func (d *DiskBackend) MigrateLayout(fn func(id uuid.UUID)) error {
+	paths, err := d.blobFiles()
+	if err != nil {
+		return err
+	}
+	emptied := map[string]bool{}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".deleted") {
+			continue // debris cleaned up by Check
+		}
+		id, err := blobID(name)
+		if err != nil {
+			continue
+		}
+		dirs, err := d.dirs(id)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		if dir == dirs[0] || !containsString(dirs[1:], dir) {
+			continue // already migrated or misplaced, see Check
+		}
+		if err := os.MkdirAll(dirs[0], 0777); err != nil {
+			return err
+		}
+		// Link rather than rename so that a newer file written to the
+		// destination, such as updated metadata, is never replaced
+		err = os.Link(path, filepath.Join(dirs[0], name))
+		if os.IsNotExist(err) {
+			continue // deleted while migrating
+		} else if err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := syncDir(dirs[0]); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Variants are not moved, they are generated again when needed
+		if err := os.RemoveAll(path + variantsExt); err != nil {
+			return err
+		}
+		emptied[dir] = true
+		if strings.HasSuffix(name, ".json") && fn != nil {
+			fn(id)
+		}
+	}
+	root := filepath.Clean(d.Dir)
+	for dir := range emptied {
+		// Remove fails once a directory with other files is reached
+		for dir != root && os.Remove(dir) == nil {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
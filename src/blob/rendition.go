@@ -0,0 +1,86 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// Rendition is a derived image of a blob made from a named preset, which is
+// stored as a variant of the blob
+type Rendition struct {
+	Preset      string `json:"preset"`       // Thumbnail.Name of the preset definition it was made from
+	ContentType string `json:"content_type"` // MIME type of the rendition
+	Size        int64  `json:"size"`         // Filesize in bytes
+	SHA256      string `json:"sha256"`       // Hex encoded SHA-256 of the rendition data
+}
+
+// HasRendition reports whether the blob has a rendition for the preset
+// called name that was made from its current definition t
+func (b *Blob) HasRendition(name string, t Thumbnail) bool {
+	r, ok := b.Renditions[name]
+	return ok && t.SetDefaults(b.ContentType) == nil && r.Preset == t.Name()
+}
+
+// Render returns a new open read-only File of the rendition of the image
+// blob for the preset called name, which is defined by t. The rendition is
+// generated if the blob has none for the preset or it was made from another
+// definition of the preset, and recorded in Renditions. Users must close
+// the file.
+func (b *Blob) Render(name string, t Thumbnail) (File, error) {
+	f, err := b.Thumbnail(&t)
+	if err != nil {
+		return nil, err
+	}
+	if b.HasRendition(name, t) {
+		return f, nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := Rendition{
+		Preset:      t.Name(),
+		ContentType: t.ContentType(),
+		Size:        n,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+	}
+	if err := b.setRendition(name, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// setRendition records the rendition for the preset called name. The
+// variant of the rendition it replaces is deleted unless another preset
+// still uses it.
+func (b *Blob) setRendition(name string, r Rendition) error {
+	var superseded string
+	err := b.update(func(fresh *Blob) {
+		if fresh.Renditions == nil {
+			fresh.Renditions = map[string]Rendition{}
+		}
+		superseded = fresh.Renditions[name].Preset
+		fresh.Renditions[name] = r
+		for _, other := range fresh.Renditions {
+			if other.Preset == superseded {
+				superseded = ""
+			}
+		}
+	})
+	if err != nil || superseded == "" {
+		return err
+	}
+	if vb, ok := b.backend().(VariantBackend); ok {
+		if err := vb.DeleteVariant(b.ID, superseded); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package blob
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	data := new(bytes.Buffer)
+	png.Encode(data, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	b := store.New()
+	b.ContentType = "image/png"
+	if err := b.WriteFrom(data); err != nil {
+		t.Fatal(err)
+	}
+	avatar := Thumbnail{Width: 10, Height: 10, Fit: FitCover}
+	if b.HasRendition("avatar", avatar) {
+		t.Fatal("expected no rendition before rendering")
+	}
+	f, err := b.Render("avatar", avatar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 10 || img.Bounds().Dy() != 10 {
+		t.Errorf("expected 10x10 rendition got: %v", img.Bounds())
+	}
+	stored, err := store.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := stored.Renditions["avatar"]
+	if r.Preset != "w10-h10-cover.png" || r.ContentType != "image/png" || r.Size == 0 || r.SHA256 == "" {
+		t.Fatalf("expected rendition to be recorded got: %+v", r)
+	}
+	if !stored.HasRendition("avatar", avatar) {
+		t.Error("expected rendition to be current")
+	}
+	// Changing the preset makes the rendition stale until rendered again
+	avatar.Width = 20
+	if stored.HasRendition("avatar", avatar) {
+		t.Fatal("expected rendition of changed preset to be stale")
+	}
+	f, err = stored.Render("avatar", avatar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if stored, _ = store.Get(b.ID); stored.Renditions["avatar"].Preset != "w20-h10-cover.png" || !stored.HasRendition("avatar", avatar) {
+		t.Fatalf("expected rendition to be regenerated got: %+v", stored.Renditions)
+	}
+	if _, err := store.Backend().(VariantBackend).OpenVariant(b.ID, "w10-h10-cover.png"); err != ErrNotFound {
+		t.Fatalf("expected superseded rendition to be deleted got: %v", err)
+	}
+	if _, err := stored.Render("preview", Thumbnail{Width: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ = store.Get(b.ID); len(stored.Renditions) != 2 {
+		t.Fatalf("expected both renditions to be recorded got: %+v", stored.Renditions)
+	}
+}
@@ -0,0 +1,467 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"uuid"
+)
+
+// S3PartSize is the size of the parts that large blobs are split into when
+// they are streamed to S3 via a multipart upload. Blobs smaller than this are
+// stored with a single PUT.
+var S3PartSize = 8 * 1024 * 1024
+
+// S3Backend stores blobs in a bucket of an S3 compatible object store using
+// path-style addressing. Blob data is stored under the key
+// PREFIX/YYYY/MM/DD/UUID and the metadata at PREFIX/YYYY/MM/DD/UUID.json, or
+// under the directories of another Layout.
+type S3Backend struct {
+	Endpoint     string       // Base URL of the S3 service, eg https://s3.amazonaws.com
+	Bucket       string       // Bucket name
+	Prefix       string       // Optional key prefix within the bucket
+	Region       string       // Region used for request signing
+	AccessKey    string       // Access key ID
+	SecretKey    string       // Secret access key
+	SessionToken string       // Optional session token for temporary credentials
+	Layout       Layout       // Layout new blobs are written in, defaults to DateLayout
+	Client       *http.Client // Client used to make requests, defaults to http.DefaultClient
+}
+
+// NewS3Backend returns an *S3Backend configured from a URL of the form:
+//
+//	s3://[ACCESS_KEY:SECRET_KEY@]HOST[:PORT]/BUCKET[/PREFIX][?region=REGION&insecure=true]
+//
+// The insecure option talks to the endpoint over plain http, which is
+// mostly useful for local S3 stand-ins.
+func NewS3Backend(rawurl string) (*S3Backend, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" {
+		return nil, fmt.Errorf("invalid s3 backend url scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("s3 backend url must include an endpoint host")
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, errors.New("s3 backend url must include a bucket")
+	}
+	q := u.Query()
+	s := &S3Backend{
+		Endpoint: "https://" + u.Host,
+		Bucket:   parts[0],
+		Region:   q.Get("region"),
+	}
+	if len(parts) == 2 {
+		s.Prefix = parts[1]
+	}
+	if insecure, _ := strconv.ParseBool(q.Get("insecure")); insecure {
+		s.Endpoint = "http://" + u.Host
+	}
+	if u.User != nil {
+		s.AccessKey = u.User.Username()
+		s.SecretKey, _ = u.User.Password()
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	return s, nil
+}
+
+// S3Error is the error returned when the S3 service responds with a non
+// successful status.
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// key returns the object key new blob files are written to relative to the
+// bucket
+func (s *S3Backend) key(id uuid.UUID, ext string) string {
+	return s.keys(id, ext)[0]
+}
+
+// keys returns the object keys the blob file may be stored under, starting
+// with the key new files are written to
+func (s *S3Backend) keys(id uuid.UUID, ext string) []string {
+	keys := s.Layout.searchDirs(id)
+	for i, dir := range keys {
+		keys[i] = path.Join(dir, id.String()) + ext
+		if prefix := strings.Trim(s.Prefix, "/"); prefix != "" {
+			keys[i] = prefix + "/" + keys[i]
+		}
+	}
+	return keys
+}
+
+// find returns the response to a request for the first of the blob file keys
+// that exists and the key
+func (s *S3Backend) find(method string, id uuid.UUID, ext string) (*http.Response, string, error) {
+	for _, key := range s.keys(id, ext) {
+		res, err := s.do(method, key, nil, nil, nil)
+		if err != ErrNotFound {
+			return res, key, err
+		}
+	}
+	return nil, "", ErrNotFound
+}
+
+func (s *S3Backend) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// do sends a signed request for the object key with an optional body and
+// returns the response if the status is successful.
+func (s *S3Backend) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	rawurl := strings.TrimRight(s.Endpoint, "/") + "/" + uriEncode(s.Bucket, false) + "/" + uriEncode(key, true)
+	if len(query) > 0 {
+		rawurl += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.Region, s.AccessKey, s.SecretKey, s.SessionToken, timeNow())
+	res, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		e := &S3Error{StatusCode: res.StatusCode}
+		if method != "HEAD" {
+			data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+			xml.Unmarshal(data, e)
+		}
+		return nil, e
+	}
+	return res, nil
+}
+
+// putObject stores data at key with a single PUT
+func (s *S3Backend) putObject(key string, data []byte, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	res, err := s.do("PUT", key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+// putMultipart streams src to key in S3PartSize chunks. first holds data
+// that has already been read from src.
+func (s *S3Backend) putMultipart(key string, first []byte, src io.Reader) (n int64, err error) {
+	res, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiate)
+	res.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	uploadID := initiate.UploadID
+	defer func() {
+		if err != nil {
+			if res, err := s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil); err == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+	complete := s3CompleteMultipartUpload{}
+	buf := first
+	for len(buf) > 0 {
+		num := len(complete.Parts) + 1
+		query := url.Values{
+			"partNumber": {strconv.Itoa(num)},
+			"uploadId":   {uploadID},
+		}
+		res, err := s.do("PUT", key, query, nil, buf)
+		if err != nil {
+			return n, err
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, s3Part{
+			PartNumber: num,
+			ETag:       res.Header.Get("ETag"),
+		})
+		n += int64(len(buf))
+		if cap(buf) < S3PartSize {
+			buf = make([]byte, S3PartSize)
+		}
+		buf = buf[:S3PartSize]
+		m, err := io.ReadFull(src, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return n, err
+		}
+		buf = buf[:m]
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return n, err
+	}
+	res, err = s.do("POST", key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return n, err
+	}
+	defer res.Body.Close()
+	// S3 may report a failure to complete in the body of a 200 response
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return n, err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &S3Error{StatusCode: res.StatusCode}
+		xml.Unmarshal(data, e)
+		return n, e
+	}
+	return n, nil
+}
+
+// Put streams the blob data to the bucket. Data larger than S3PartSize is
+// sent as a multipart upload so that it never has to be held in memory as
+// a whole.
+func (s *S3Backend) Put(id uuid.UUID, src io.Reader) (int64, error) {
+	key := s.key(id, "")
+	// The buffer grows with the data, so small blobs do not cost a part
+	head := new(bytes.Buffer)
+	n, err := io.CopyN(head, src, int64(S3PartSize))
+	switch err {
+	case io.EOF:
+		return n, s.putObject(key, head.Bytes(), "")
+	case nil:
+		return s.putMultipart(key, head.Bytes(), src)
+	default:
+		return 0, err
+	}
+}
+
+// Open returns a File that streams the blob data from the bucket. Seeking
+// is supported by issuing ranged GET requests.
+func (s *S3Backend) Open(id uuid.UUID) (File, error) {
+	res, key, err := s.find("HEAD", id, "")
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return &s3File{
+		s:    s,
+		key:  key,
+		size: res.ContentLength,
+	}, nil
+}
+
+// Stat returns the size of the blob data object
+func (s *S3Backend) Stat(id uuid.UUID) (int64, error) {
+	res, _, err := s.find("HEAD", id, "")
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.ContentLength, nil
+}
+
+// Delete removes the blob metadata and data objects under the keys of every
+// layout
+func (s *S3Backend) Delete(id uuid.UUID) error {
+	// S3 does not report missing keys on DELETE so check first
+	res, _, err := s.find("HEAD", id, ".json")
+	if err != nil && err != ErrNotFound {
+		return err
+	} else if err == nil {
+		res.Body.Close()
+	}
+	found := err == nil
+	keys := append(s.keys(id, ".json"), s.keys(id, "")...)
+	for _, key := range keys {
+		res, err := s.do("DELETE", key, nil, nil, nil)
+		if err != nil && err != ErrNotFound {
+			return err
+		} else if err == nil {
+			res.Body.Close()
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReadMeta fetches the metadata json object
+func (s *S3Backend) ReadMeta(id uuid.UUID) ([]byte, error) {
+	res, _, err := s.find("GET", id, ".json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// WriteMeta stores the metadata json object and removes any copies under
+// the keys of other layouts, so that it is not shadowed by stale copies
+func (s *S3Backend) WriteMeta(id uuid.UUID, data []byte) error {
+	keys := s.keys(id, ".json")
+	if err := s.putObject(keys[0], data, "application/json"); err != nil {
+		return err
+	}
+	for _, key := range keys[1:] {
+		res, err := s.do("DELETE", key, nil, nil, nil)
+		if err != nil && err != ErrNotFound {
+			return err
+		} else if err == nil {
+			res.Body.Close()
+		}
+	}
+	return nil
+}
+
+// Walk lists the metadata objects in the bucket under the prefix and calls
+// fn with the ID of each blob.
+func (s *S3Backend) Walk(fn func(id uuid.UUID) error) error {
+	prefix := strings.Trim(s.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		res, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			if !strings.HasSuffix(obj.Key, ".json") {
+				continue
+			}
+			id, err := uuid.ParseUUID(path.Base(strings.TrimSuffix(obj.Key, ".json")))
+			if err != nil {
+				continue // not a blob
+			}
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// s3File reads an object lazily, opening a new ranged GET whenever the read
+// offset is moved by Seek.
+type s3File struct {
+	s      *S3Backend
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		res, err := f.s.do("GET", f.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		f.body = res.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
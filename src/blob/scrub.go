@@ -0,0 +1,253 @@
+package blob
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"uuid"
+)
+
+// ErrCorrupt is returned when reading blob data that failed verification
+var ErrCorrupt = errors.New("blob data is corrupt")
+
+// errStopped is returned by Scrubber.Pass when it was stopped
+var errStopped = errors.New("scrub stopped")
+
+// Verify re-reads the blob data and compares it with the stored size and
+// checksums. The time of verification and whether the data is corrupt are
+// recorded in the metadata. ErrCorrupt is returned if the data does not
+// match. Blobs stored before checksums were recorded have them set from the
+// data.
+func (b *Blob) Verify() error {
+	return b.verify(nil)
+}
+
+func (b *Blob) verify(limit *rateLimiter) error {
+	f, err := b.backend().Open(b.ID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var src io.Reader = f
+	if limit != nil {
+		src = &rateLimitedReader{r: f, l: limit}
+	}
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(sha256Hash, md5Hash), src)
+	if err != nil {
+		return err
+	}
+	sha256Sum := hex.EncodeToString(sha256Hash.Sum(nil))
+	md5Sum := hex.EncodeToString(md5Hash.Sum(nil))
+	corrupt := n != b.Size ||
+		(b.SHA256 != "" && !strings.EqualFold(b.SHA256, sha256Sum)) ||
+		(b.MD5 != "" && !strings.EqualFold(b.MD5, md5Sum))
+	// Reload the metadata so changes made while reading are kept
+	err = b.update(func(fresh *Blob) {
+		now := time.Now().UTC()
+		fresh.VerifiedAt = &now
+		fresh.Corrupt = corrupt
+		if !corrupt && fresh.SHA256 == "" {
+			fresh.SHA256 = sha256Sum
+			fresh.MD5 = md5Sum
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if corrupt {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// rateLimiter limits the average rate of reads to a number of bytes per second
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait records that n bytes were read and sleeps until the average rate is
+// back under the limit
+func (l *rateLimiter) wait(n int) {
+	l.n += int64(n)
+	due := time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second))
+	if d := due - time.Since(l.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type rateLimitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.l.rate {
+		p = p[:r.l.rate]
+	}
+	n, err := r.r.Read(p)
+	r.l.wait(n)
+	return n, err
+}
+
+// Scrubber periodically re-verifies the data of every blob in a Store to
+// detect silent corruption. Blobs found corrupt are marked so that reading
+// their data returns ErrCorrupt.
+type Scrubber struct {
+	Store    *Store
+	Interval time.Duration // How often each blob is verified
+	Rate     int64         // Maximum bytes read per second, 0 for no limit
+
+	mu      sync.Mutex
+	stats   ScrubStats
+	corrupt map[uuid.UUID]bool
+}
+
+// ScrubStats reports the progress of a Scrubber
+type ScrubStats struct {
+	Passes     int64       `json:"passes"`               // Completed passes over the store
+	Verified   int64       `json:"verified"`             // Blobs verified
+	Bytes      int64       `json:"bytes"`                // Bytes of blob data verified
+	Errors     int64       `json:"errors"`               // Blobs that could not be verified
+	Corrupt    int64       `json:"corrupt"`              // Blobs currently marked corrupt
+	CorruptIDs []uuid.UUID `json:"corrupt_ids"`          // IDs of the blobs marked corrupt
+	LastPass   *time.Time  `json:"last_pass,omitempty"`  // Time the last pass finished
+	LastError  string      `json:"last_error,omitempty"` // Last error verifying a blob
+}
+
+// Stats returns the progress of the scrubber
+func (s *Scrubber) Stats() ScrubStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Corrupt = int64(len(s.corrupt))
+	stats.CorruptIDs = []uuid.UUID{}
+	for id := range s.corrupt {
+		stats.CorruptIDs = append(stats.CorruptIDs, id)
+	}
+	sort.Slice(stats.CorruptIDs, func(i, j int) bool {
+		return stats.CorruptIDs[i].String() < stats.CorruptIDs[j].String()
+	})
+	return stats
+}
+
+// Run scrubs the store until stop is closed, waiting between passes
+func (s *Scrubber) Run(stop <-chan struct{}) {
+	pause := s.Interval
+	if pause > time.Hour {
+		pause = time.Hour
+	}
+	for {
+		if err := s.Pass(stop); err == errStopped {
+			return
+		} else if err != nil {
+			s.record(func(stats *ScrubStats) { stats.LastError = err.Error() })
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(pause):
+		}
+	}
+}
+
+// Pass verifies each blob in the store that has not been verified, or
+// created, within the Interval.
+func (s *Scrubber) Pass(stop <-chan struct{}) error {
+	walker, ok := s.Store.Backend().(Walker)
+	if !ok {
+		return errors.New("blob backend does not support walking blobs")
+	}
+	var limit *rateLimiter
+	if s.Rate > 0 {
+		limit = newRateLimiter(s.Rate)
+	}
+	corrupt := map[uuid.UUID]bool{}
+	mark := func(b *Blob) {
+		if b.Corrupt {
+			corrupt[b.ID] = true
+		}
+		s.mark(b.ID, b.Corrupt)
+	}
+	err := walker.Walk(func(id uuid.UUID) error {
+		select {
+		case <-stop:
+			return errStopped
+		default:
+		}
+		b, err := s.Store.Get(id)
+		if err == ErrNotFound {
+			return nil // deleted while walking
+		} else if err != nil {
+			s.record(func(stats *ScrubStats) { stats.Errors++; stats.LastError = err.Error() })
+			return nil
+		}
+		if !s.due(b) {
+			mark(b)
+			return nil
+		}
+		err = b.verify(limit)
+		switch err {
+		case nil, ErrCorrupt:
+			mark(b)
+			s.record(func(stats *ScrubStats) { stats.Verified++; stats.Bytes += b.Size })
+		case ErrNotFound:
+		default:
+			s.record(func(stats *ScrubStats) { stats.Errors++; stats.LastError = err.Error() })
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Forget blobs that were deleted since they were marked
+	s.corrupt = corrupt
+	now := time.Now().UTC()
+	s.stats.Passes++
+	s.stats.LastPass = &now
+	return nil
+}
+
+// due reports whether the blob should be verified again
+func (s *Scrubber) due(b *Blob) bool {
+	last := b.Time()
+	if b.VerifiedAt != nil {
+		last = *b.VerifiedAt
+	}
+	return time.Since(last) >= s.Interval
+}
+
+// mark records whether the blob is corrupt
+func (s *Scrubber) mark(id uuid.UUID, corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.corrupt == nil {
+		s.corrupt = map[uuid.UUID]bool{}
+	}
+	if corrupt {
+		s.corrupt[id] = true
+	} else {
+		delete(s.corrupt, id)
+	}
+}
+
+func (s *Scrubber) record(fn func(stats *ScrubStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.stats)
+}
@@ -0,0 +1,74 @@
+package blob
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	old := time.Now().Add(-2 * time.Hour)
+	good := indexedBlob(t, store, old, "good.txt", "text/plain", "good", nil)
+	bad := indexedBlob(t, store, old, "bad.txt", "text/plain", "good", nil)
+	recent := indexedBlob(t, store, time.Now(), "recent.txt", "text/plain", "good", nil)
+	// Same size so only the checksum differs
+	store.Backend().Put(bad.ID, strings.NewReader("evil"))
+	store.Backend().Put(recent.ID, strings.NewReader("evil"))
+	s := &Scrubber{Store: store, Interval: time.Hour}
+	if err := s.Pass(nil); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	if stats.Passes != 1 || stats.Verified != 2 || stats.Corrupt != 1 || stats.CorruptIDs[0] != bad.ID {
+		t.Fatalf("expected 2 blobs verified and 1 corrupt got: %+v", stats)
+	}
+	if b, _ := store.Get(good.ID); b.Corrupt || b.VerifiedAt == nil {
+		t.Fatalf("expected good blob to be verified got: %+v", b)
+	}
+	b, _ := store.Get(bad.ID)
+	if !b.Corrupt || b.VerifiedAt == nil {
+		t.Fatalf("expected bad blob to be marked corrupt got: %+v", b)
+	}
+	if _, err := b.File(); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt reading corrupt blob got: %v", err)
+	}
+	// Recently verified blobs are skipped
+	if err := s.Pass(nil); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Verified != 2 || stats.Corrupt != 1 {
+		t.Fatalf("expected no more blobs verified got: %+v", stats)
+	}
+	// Restored data clears the mark
+	store.Backend().Put(bad.ID, strings.NewReader("good"))
+	if err := b.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := recent.Verify(); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt got: %v", err)
+	}
+	s.Pass(nil)
+	if stats := s.Stats(); stats.Corrupt != 1 || stats.CorruptIDs[0] != recent.ID {
+		t.Fatalf("expected only the recent blob to be corrupt got: %+v", stats)
+	}
+}
+
+func TestVerifySetsMissingChecksums(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	b := indexedBlob(t, store, time.Now(), "old.txt", "text/plain", "old", nil)
+	sum := b.SHA256
+	b.SHA256, b.MD5 = "", ""
+	if err := b.marshal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if b.SHA256 != sum || b.MD5 == "" {
+		t.Fatalf("expected checksums to be recorded got: %+v", b)
+	}
+}
@@ -0,0 +1,250 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"strings"
+)
+
+// SniffLen is the number of leading bytes of blob data that Sniff looks at
+const SniffLen = 8192
+
+// signature identifies a content type by the bytes at an offset
+type signature struct {
+	offset      int
+	magic       string
+	contentType string
+}
+
+// signatures are checked in order before falling back to
+// http.DetectContentType, which covers common image, audio, video, font,
+// archive and text formats.
+var signatures = []signature{
+	// Executables, see also isPE
+	{0, "\x7fELF", "application/x-elf"},
+	{0, "\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{0, "\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{0, "\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{0, "\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	// Office documents from before OOXML
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+	{0, "{\\rtf", "application/rtf"},
+	// Images
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{0, "8BPS", "image/vnd.adobe.photoshop"},
+	// Audio and video
+	{0, "fLaC", "audio/flac"},
+	{0, "\x1aE\xdf\xa3", "video/x-matroska"},
+	// Archives
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// ftypBrands maps the major brand of ISO base media files to content types
+var ftypBrands = map[string]string{
+	"qt  ": "video/quicktime",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"M4V ": "video/x-m4v",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"avif": "image/avif",
+}
+
+// Sniff returns the content type of data from its leading bytes, of which
+// it considers at most SniffLen. It returns "application/octet-stream" if
+// the type cannot be determined.
+func Sniff(data []byte) string {
+	if len(data) > SniffLen {
+		data = data[:SniffLen]
+	}
+	if isPE(data) {
+		return "application/vnd.microsoft.portable-executable"
+	}
+	for _, s := range signatures {
+		if len(data) >= s.offset+len(s.magic) && string(data[s.offset:s.offset+len(s.magic)]) == s.magic {
+			return s.contentType
+		}
+	}
+	// ISO base media files such as MP4 and HEIC
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		if t, ok := ftypBrands[string(data[8:12])]; ok {
+			return t
+		}
+		return "video/mp4"
+	}
+	detected := http.DetectContentType(data)
+	switch mediaType(detected) {
+	case "application/zip":
+		return sniffZip(data)
+	case "video/webm":
+		if !bytes.Contains(data, []byte("webm")) {
+			return "video/x-matroska"
+		}
+	case "text/xml", "text/plain":
+		if isSVG(data) {
+			return "image/svg+xml"
+		}
+	}
+	return detected
+}
+
+// isSVG reports whether the root element of the XML document in data is an
+// svg element, skipping the XML declaration, doctype, processing
+// instructions and comments before it
+func isSVG(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	for {
+		data = bytes.TrimLeft(data, " \t\r\n")
+		var end []byte
+		switch {
+		case bytes.HasPrefix(data, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(data, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(data, []byte("<!")):
+			// A doctype may have an internal subset in brackets
+			end = []byte(">")
+			if i := bytes.IndexAny(data, "[>"); i >= 0 && data[i] == '[' {
+				end = []byte("]>")
+			}
+		default:
+			if !bytes.HasPrefix(data, []byte("<svg")) || len(data) == 4 {
+				return false
+			}
+			return bytes.IndexByte([]byte(" \t\r\n>/"), data[4]) >= 0
+		}
+		i := bytes.Index(data, end)
+		if i < 0 {
+			return false
+		}
+		data = data[i+len(end):]
+	}
+}
+
+// isPE reports whether data starts with the DOS header of a Windows
+// executable that points at a PE header within data
+func isPE(data []byte) bool {
+	if len(data) < 64 || string(data[:2]) != "MZ" {
+		return false
+	}
+	off := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	if off < 0 || off+4 > len(data) {
+		return false
+	}
+	return string(data[off:off+4]) == "PE\x00\x00"
+}
+
+// sniffZip returns the content type of zip based formats from the names and
+// contents of their first entries
+func sniffZip(data []byte) string {
+	// OpenDocument and EPUB start with an uncompressed mimetype entry
+	if len(data) > 38 && string(data[30:38]) == "mimetype" {
+		rest := data[38:]
+		// The size is in the local header unless a data descriptor follows
+		end := int(binary.LittleEndian.Uint32(data[18:22]))
+		if end == 0 || end > len(rest) {
+			end = bytes.Index(rest, []byte("PK"))
+		}
+		if end > 0 {
+			t := string(rest[:end])
+			if strings.HasPrefix(t, "application/") {
+				return t
+			}
+		}
+	}
+	switch {
+	case bytes.Contains(data, []byte("word/")):
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case bytes.Contains(data, []byte("xl/")):
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case bytes.Contains(data, []byte("ppt/")):
+		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	case bytes.Contains(data, []byte("META-INF/MANIFEST.MF")):
+		return "application/java-archive"
+	}
+	return "application/zip"
+}
+
+// sniffFamilies lists the claimed types, or prefixes of them, that are
+// consistent with a sniffed type that is less specific
+var sniffFamilies = map[string][]string{
+	"text/plain":                {"text/", "application/json", "application/xml", "application/javascript", "application/x-yaml", "application/x-sh"},
+	"text/xml":                  {"text/", "application/xml", "application/rss+xml", "application/atom+xml"},
+	"text/html":                 {"text/", "application/xhtml+xml"},
+	"image/svg+xml":             {"text/xml", "application/xml"},
+	"application/zip":           {"application/vnd.openxmlformats-officedocument.", "application/vnd.oasis.opendocument.", "application/epub+zip", "application/java-archive", "application/vnd.android.package-archive", "application/x-zip"},
+	"application/java-archive":  {"application/zip", "application/x-zip", "application/vnd.android.package-archive"},
+	"application/x-ole-storage": {"application/msword", "application/vnd.ms-", "application/x-msi"},
+	"application/x-gzip":        {"application/gzip", "application/x-gtar", "application/x-compressed-tar", "application/x-tgz"},
+	"application/x-tar":         {"application/x-gtar"},
+	"application/ogg":           {"audio/ogg", "video/ogg", "audio/opus"},
+	"audio/wave":                {"audio/wav", "audio/x-wav", "audio/vnd.wave"},
+	"audio/mpeg":                {"audio/mp3"},
+	"audio/mp4":                 {"audio/x-m4a", "video/mp4"},
+	"video/mp4":                 {"audio/mp4", "audio/x-m4a", "video/x-m4v", "video/quicktime", "video/3gpp"},
+	"video/quicktime":           {"video/mp4"},
+	"video/webm":                {"audio/webm", "video/x-matroska"},
+	"video/x-matroska":          {"video/webm", "audio/x-matroska", "audio/webm"},
+	"image/x-icon":              {"image/vnd.microsoft.icon"},
+	"image/heif":                {"image/heic"},
+	"application/vnd.microsoft.portable-executable": {"application/x-msdownload", "application/x-dosexec"},
+}
+
+// sniffable are the claimed types, or prefixes of them, that Sniff would
+// recognize, so data it does not recognize cannot be of them
+var sniffable = []string{"image/", "audio/", "video/", "text/", "application/pdf", "application/zip", "application/x-gzip", "application/gzip"}
+
+// scriptable are the types browsers run scripts in, which are only trusted
+// when Sniff detects them so that plain text cannot be served as HTML
+var scriptable = []string{"text/html", "application/xhtml+xml", "image/svg+xml"}
+
+// Scriptable reports whether browsers run scripts in content of the type
+func Scriptable(contentType string) bool {
+	return hasTypePrefix(scriptable, mediaType(contentType))
+}
+
+// TypesConflict reports whether the type detected by Sniff contradicts the
+// claimed type of the data. Claimed types that are more specific than the
+// detected type, such as text/csv for text/plain or a docx for a zip, do not
+// conflict, unless they are scriptable.
+func TypesConflict(claimed, detected string) bool {
+	claimed, detected = mediaType(claimed), mediaType(detected)
+	if claimed == "" || claimed == detected {
+		return false
+	}
+	if Scriptable(claimed) && !Scriptable(detected) {
+		return true
+	}
+	if detected == "application/octet-stream" {
+		return hasTypePrefix(sniffable, claimed)
+	}
+	return !hasTypePrefix(sniffFamilies[detected], claimed)
+}
+
+// hasTypePrefix reports whether t starts with one of the prefixes
+func hasTypePrefix(prefixes []string, t string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(t, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns the lowercase media type of a content type without its
+// parameters
+func mediaType(contentType string) string {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
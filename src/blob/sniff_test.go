@@ -0,0 +1,88 @@
+package blob
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	pe := make([]byte, 128)
+	copy(pe, "MZ")
+	pe[0x3c] = 64
+	copy(pe[64:], "PE\x00\x00")
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+	docx := new(bytes.Buffer)
+	zw := zip.NewWriter(docx)
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("<xml/>"))
+	}
+	zw.Close()
+	odt := new(bytes.Buffer)
+	zw = zip.NewWriter(odt)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	w.Write([]byte("application/vnd.oasis.opendocument.text"))
+	w, _ = zw.Create("content.xml")
+	w.Write([]byte("<xml/>"))
+	zw.Close()
+	svgDoc := "<?xml version=\"1.0\"?>\n<!-- drawn by hand -->\n<!DOCTYPE svg [<!ENTITY x \"<svg>\">]>\n<svg>"
+	cases := map[string]string{
+		string(pe):                                       "application/vnd.microsoft.portable-executable",
+		"MZ is how this text starts":                     "text/plain; charset=utf-8",
+		"\x7fELF\x02\x01\x01":                            "application/x-elf",
+		"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1":               "application/x-ole-storage",
+		"\x00\x00\x00\x18ftypqt  ":                       "video/quicktime",
+		"\x00\x00\x00\x18ftypisom":                       "video/mp4",
+		"\x00\x00\x00\x18ftypheic":                       "image/heic",
+		"fLaC\x00\x00\x00\x22":                           "audio/flac",
+		"7z\xbc\xaf\x27\x1c\x00\x04":                     "application/x-7z-compressed",
+		string(tarHeader):                                "application/x-tar",
+		docx.String():                                    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		odt.String():                                     "application/vnd.oasis.opendocument.text",
+		"\x89PNG\r\n\x1a\n":                              "image/png",
+		`<svg xmlns="http://www.w3.org/2000/svg"></svg>`: "image/svg+xml",
+		svgDoc:                                   "image/svg+xml",
+		"notes about the <svg> element":          "text/plain; charset=utf-8",
+		`<?xml version="1.0"?><doc><svg/></doc>`: "text/xml; charset=utf-8",
+		"<svgx/>":                                "text/plain; charset=utf-8",
+		string(pe[:66]):                          "application/octet-stream",
+		"%PDF-1.4":                               "application/pdf",
+		"\x00\x01\x02\x03":                       "application/octet-stream",
+	}
+	for data, exp := range cases {
+		if got := Sniff([]byte(data)); got != exp {
+			t.Errorf("expected %s got: %s", exp, got)
+		}
+	}
+}
+
+func TestTypesConflict(t *testing.T) {
+	cases := []struct {
+		claimed, detected string
+		conflict          bool
+	}{
+		{"image/jpeg", "image/jpeg", false},
+		{"", "image/jpeg", false},
+		{"text/csv", "text/plain; charset=utf-8", false},
+		{"application/json", "text/plain; charset=utf-8", false},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/zip", false},
+		{"application/msword", "application/x-ole-storage", false},
+		{"audio/mp4", "video/mp4", false},
+		{"application/x-custom", "application/octet-stream", false},
+		{"image/jpeg", "application/vnd.microsoft.portable-executable", true},
+		{"image/jpeg", "application/octet-stream", true},
+		{"image/png", "image/jpeg", true},
+		{"text/plain", "application/x-elf", true},
+		{"text/html", "text/plain; charset=utf-8", true},
+		{"application/xhtml+xml", "text/xml; charset=utf-8", true},
+		{"image/svg+xml", "text/plain; charset=utf-8", true},
+		{"application/xhtml+xml", "text/html; charset=utf-8", false},
+	}
+	for _, c := range cases {
+		if got := TypesConflict(c.claimed, c.detected); got != c.conflict {
+			t.Errorf("expected conflict=%v for %s claimed as %s got: %v", c.conflict, c.detected, c.claimed, got)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // register formats for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"runtime"
+)
+
+// Fit modes of a Thumbnail
+const (
+	FitContain = "contain" // scale to fit within the box keeping the aspect ratio
+	FitCover   = "cover"   // scale to cover the box keeping the aspect ratio, cropping the overflow
+	FitFill    = "fill"    // stretch to the box ignoring the aspect ratio
+)
+
+// MaxImagePixels limits the width times height of the images thumbnails are
+// made from, as the decoded image is kept in memory.
+var MaxImagePixels = 50000000
+
+// resizing holds a slot for each image being decoded and resized, so no
+// more are held in memory at once than there are CPUs to resize them
+var resizing = make(chan struct{}, runtime.NumCPU())
+
+// ErrNotImage is returned when making a thumbnail of a blob that is not an
+// image in a supported format
+var ErrNotImage = errors.New("blob is not a supported image")
+
+// ErrImageTooLarge is returned when making a thumbnail of an image with more
+// than MaxImagePixels pixels
+var ErrImageTooLarge = errors.New("image is too large to resize")
+
+// Thumbnail describes a resized variant of an image blob
+type Thumbnail struct {
+	Width  int    // Width of the box to resize to, 0 to keep the aspect ratio
+	Height int    // Height of the box to resize to, 0 to keep the aspect ratio
+	Fit    string // How to fit the image to the box, defaults to FitContain
+	Format string // Output format, jpeg or png, defaults to jpeg for jpeg images and png otherwise
+}
+
+// thumbnailSources are the content types of images that can be resized
+var thumbnailSources = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "png",
+}
+
+// SetDefaults fills in the defaults for an image of contentType and checks
+// that the thumbnail can be made
+func (t *Thumbnail) SetDefaults(contentType string) error {
+	format, ok := thumbnailSources[mediaType(contentType)]
+	if !ok {
+		return ErrNotImage
+	}
+	if t.Width < 0 || t.Height < 0 || t.Width == 0 && t.Height == 0 {
+		return errors.New("thumbnail needs a positive width or height")
+	}
+	switch t.Fit {
+	case "":
+		t.Fit = FitContain
+	case FitContain, FitCover, FitFill:
+	default:
+		return fmt.Errorf("invalid thumbnail fit %q", t.Fit)
+	}
+	switch t.Format {
+	case "":
+		t.Format = format
+	case "jpg":
+		t.Format = "jpeg"
+	case "jpeg", "png":
+	default:
+		return fmt.Errorf("invalid thumbnail format %q", t.Format)
+	}
+	return nil
+}
+
+// Name returns the name of the variant the thumbnail is cached as
+func (t *Thumbnail) Name() string {
+	return fmt.Sprintf("w%d-h%d-%s.%s", t.Width, t.Height, t.Fit, t.Format)
+}
+
+// ContentType returns the content type of the thumbnail data
+func (t *Thumbnail) ContentType() string {
+	return "image/" + t.Format
+}
+
+// geometry returns the rectangle of an image of size sw x sh to resize and
+// the size to resize it to
+func (t *Thumbnail) geometry(sw, sh int) (crop image.Rectangle, w, h int) {
+	crop = image.Rect(0, 0, sw, sh)
+	w, h = t.Width, t.Height
+	switch {
+	case w == 0:
+		w = scaleDim(sw, h, sh)
+	case h == 0:
+		h = scaleDim(sh, w, sw)
+	case t.Fit == FitContain:
+		if w*sh <= h*sw {
+			h = scaleDim(sh, w, sw)
+		} else {
+			w = scaleDim(sw, h, sh)
+		}
+	case t.Fit == FitCover:
+		// Crop the middle of the source to the aspect ratio of the box
+		if w*sh > h*sw {
+			ch := scaleDim(h, sw, w)
+			crop = image.Rect(0, (sh-ch)/2, sw, (sh-ch)/2+ch)
+		} else {
+			cw := scaleDim(w, sh, h)
+			crop = image.Rect((sw-cw)/2, 0, (sw-cw)/2+cw, sh)
+		}
+	}
+	return crop, w, h
+}
+
+// scaleDim returns n scaled by num/den, rounded and at least 1
+func scaleDim(n, num, den int) int {
+	n = (n*num + den/2) / den
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Thumbnail returns a new open read-only File of the image blob resized as
+// described by t, which is generated on first use and cached as a variant.
+// The defaults of t are filled in for the blob. Users must close the file.
+func (b *Blob) Thumbnail(t *Thumbnail) (File, error) {
+	if err := t.SetDefaults(b.ContentType); err != nil {
+		return nil, err
+	}
+	return b.Variant(t.Name(), func(w io.Writer) error {
+		resizing <- struct{}{}
+		defer func() { <-resizing }()
+		f, err := b.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return t.resize(w, f)
+	})
+}
+
+// resize writes the thumbnail of the image read from f to w
+func (t *Thumbnail) resize(w io.Writer, f File) error {
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ErrNotImage
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return ErrImageTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ErrNotImage
+	}
+	bounds := img.Bounds()
+	crop, width, height := t.geometry(bounds.Dx(), bounds.Dy())
+	src := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	if t.Format == "jpeg" {
+		// JPEG has no transparency so flatten onto white
+		draw.Draw(src, src.Bounds(), image.White, image.Point{}, draw.Src)
+	}
+	draw.Draw(src, src.Bounds(), img, crop.Min.Add(bounds.Min), draw.Over)
+	dst := scale(src, width, height)
+	if t.Format == "jpeg" {
+		return jpeg.Encode(w, dst, &jpeg.Options{Quality: 85})
+	}
+	return png.Encode(w, dst)
+}
+
+// scale resizes src to w x h by averaging the source pixels covered by each
+// destination pixel
+func scale(src *image.RGBA, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		y0, y1 := span(y, h, sh)
+		for x := 0; x < w; x++ {
+			x0, x1 := span(x, w, sw)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[i+c])
+					}
+					i += 4
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// span returns the range of the size source pixels covered by pixel i of n
+// destination pixels
+func span(i, n, size int) (int, int) {
+	lo, hi := i*size/n, (i+1)*size/n
+	if hi <= lo {
+		hi = lo + 1
+	}
+	return lo, hi
+}
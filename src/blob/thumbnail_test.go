@@ -0,0 +1,135 @@
+package blob
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestThumbnailGeometry(t *testing.T) {
+	cases := []struct {
+		thumb  Thumbnail
+		crop   image.Rectangle
+		width  int
+		height int
+	}{
+		{Thumbnail{Width: 100, Fit: FitContain}, image.Rect(0, 0, 400, 200), 100, 50},
+		{Thumbnail{Height: 100, Fit: FitContain}, image.Rect(0, 0, 400, 200), 200, 100},
+		{Thumbnail{Width: 100, Height: 100, Fit: FitContain}, image.Rect(0, 0, 400, 200), 100, 50},
+		{Thumbnail{Width: 100, Height: 100, Fit: FitFill}, image.Rect(0, 0, 400, 200), 100, 100},
+		{Thumbnail{Width: 100, Height: 100, Fit: FitCover}, image.Rect(100, 0, 300, 200), 100, 100},
+		{Thumbnail{Width: 200, Height: 50, Fit: FitCover}, image.Rect(0, 50, 400, 150), 200, 50},
+		{Thumbnail{Width: 1, Fit: FitContain}, image.Rect(0, 0, 400, 200), 1, 1},
+	}
+	for _, c := range cases {
+		crop, w, h := c.thumb.geometry(400, 200)
+		if crop != c.crop || w != c.width || h != c.height {
+			t.Errorf("%+v: expected %v %dx%d got: %v %dx%d", c.thumb, c.crop, c.width, c.height, crop, w, h)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(NewDiskBackend(dir))
+	// Left half red, right half blue
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 20 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	data := new(bytes.Buffer)
+	png.Encode(data, img)
+	b := store.New()
+	b.ContentType = "image/png"
+	if err := b.WriteFrom(data); err != nil {
+		t.Fatal(err)
+	}
+
+	thumb := func(th *Thumbnail) image.Image {
+		f, err := b.Thumbnail(th)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		img, _, err := image.Decode(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	th := &Thumbnail{Width: 10}
+	small := thumb(th)
+	if th.Fit != FitContain || th.Format != "png" || th.Name() != "w10-h0-contain.png" {
+		t.Errorf("expected defaults to be filled in got: %+v", th)
+	}
+	if small.Bounds().Dx() != 10 || small.Bounds().Dy() != 5 {
+		t.Errorf("expected 10x5 thumbnail got: %v", small.Bounds())
+	}
+	if r, _, bl, _ := small.At(0, 0).RGBA(); r>>8 != 255 || bl != 0 {
+		t.Errorf("expected red left edge got: %v", small.At(0, 0))
+	}
+	if r, _, bl, _ := small.At(9, 4).RGBA(); r != 0 || bl>>8 != 255 {
+		t.Errorf("expected blue right edge got: %v", small.At(9, 4))
+	}
+	path, _ := b.Path()
+	if _, err := os.Stat(path + variantsExt + "/w10-h0-contain.png"); err != nil {
+		t.Errorf("expected thumbnail to be cached: %v", err)
+	}
+	// Cached thumbnails are served without reading the blob data
+	ioutil.WriteFile(path, []byte("not an image"), 0644)
+	if thumb(&Thumbnail{Width: 10}).Bounds().Dx() != 10 {
+		t.Error("expected cached thumbnail")
+	}
+	if _, err := b.Thumbnail(&Thumbnail{Width: 8, Height: 8, Fit: FitCover, Format: "jpg"}); err != ErrNotImage {
+		t.Errorf("expected ErrNotImage got: %v", err)
+	}
+	data.Reset()
+	png.Encode(data, img)
+	ioutil.WriteFile(path, data.Bytes(), 0644)
+	th = &Thumbnail{Width: 8, Height: 8, Fit: FitCover, Format: "jpg"}
+	square := thumb(th)
+	if th.ContentType() != "image/jpeg" || square.Bounds().Dx() != 8 || square.Bounds().Dy() != 8 {
+		t.Errorf("expected 8x8 jpeg got: %s %v", th.ContentType(), square.Bounds())
+	}
+	if _, ok := square.(*image.YCbCr); !ok {
+		t.Errorf("expected jpeg data got: %T", square)
+	}
+
+	defer func(max int) { MaxImagePixels = max }(MaxImagePixels)
+	MaxImagePixels = 100
+	if _, err := b.Thumbnail(&Thumbnail{Width: 12}); err != ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge got: %v", err)
+	}
+	for _, th := range []*Thumbnail{{}, {Width: -1}, {Width: 1, Fit: "zoom"}, {Width: 1, Format: "gif"}} {
+		if _, err := b.Thumbnail(th); err == nil {
+			t.Errorf("expected %+v to be rejected", th)
+		}
+	}
+	text := store.New()
+	text.ContentType = "text/plain"
+	text.WriteFrom(bytes.NewReader([]byte("hello")))
+	if _, err := text.Thumbnail(&Thumbnail{Width: 10}); err != ErrNotImage {
+		t.Errorf("expected ErrNotImage got: %v", err)
+	}
+
+	if err := b.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + variantsExt); !os.IsNotExist(err) {
+		t.Errorf("expected variants to be deleted with the blob got: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package blob
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// validVariantName reports whether name can be used as the name of a variant
+// file, which must not escape the directory of variants of the blob
+func validVariantName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// Variant returns a new open read-only File for the variant of the blob data
+// called name, calling generate to write it if it has not been stored yet.
+// Variants are cached if the backend is a VariantBackend, otherwise they
+// are generated every time. Users must close the file.
+func (b *Blob) Variant(name string, generate func(w io.Writer) error) (File, error) {
+	if !validVariantName(name) {
+		return nil, fmt.Errorf("invalid variant name %q", name)
+	}
+	if b.Expired() {
+		return nil, ErrExpired
+	}
+	if b.Corrupt {
+		return nil, ErrCorrupt
+	}
+	vb, cached := b.backend().(VariantBackend)
+	if cached {
+		f, err := vb.OpenVariant(b.ID, name)
+		if err != ErrNotFound {
+			return f, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := generate(buf); err != nil {
+		return nil, err
+	}
+	if cached {
+		if err := vb.PutVariant(b.ID, name, bytes.NewReader(buf.Bytes())); err != nil {
+			return nil, err
+		}
+	}
+	return memoryFile{bytes.NewReader(buf.Bytes())}, nil
+}
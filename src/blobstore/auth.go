@@ -0,0 +1,299 @@
+package main
+
+import (
+	"blob"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"uuid"
+)
+
+// Scopes granted by the scope claim of a token
+const (
+	scopeRead   = "read"   // download blobs and their info, and list blobs
+	scopeWrite  = "write"  // upload blobs
+	scopeDelete = "delete" // delete blobs
+	scopeAdmin  = "admin"  // everything, including the /admin endpoints
+
+	scopeOriginal = "original" // keep the original of uploads stripped of EXIF metadata
+)
+
+// legacyScopes are granted to tokens without a scope claim, as issued before
+// scopes existed
+var legacyScopes = []string{scopeRead, scopeWrite, scopeDelete}
+
+// Read authorization modes for --read-auth
+const (
+	readAuthPublic = "public" // anyone can read blobs other than private ones with an owner
+	readAuthToken  = "token"  // reading requires a token with the read scope
+	readAuthBlob   = "blob"   // as public, but private blobs without an owner require a token
+)
+
+// claims are the authorization claims of a request token
+type claims struct {
+	Subject string      // sub claim identifying the token holder
+	Groups  []string    // groups claim naming the groups of the token holder
+	Scopes  []string    // granted scopes
+	Blobs   []uuid.UUID // blob claim restricting the token to these blobs, nil for any blob
+	MaxSize int64       // max_size claim limiting upload size in bytes, 0 for no limit
+	Types   []string    // content_type claim restricting uploads to these types, nil for any type
+}
+
+// fullAccess are the claims of every request when auth is disabled
+var fullAccess = &claims{Scopes: []string{scopeAdmin}}
+
+// parseClaims reads the claims of a decoded token. The scope and blob claims
+// may be space separated strings or arrays of strings.
+func parseClaims(raw map[string]interface{}) (*claims, error) {
+	strs := func(name string) ([]string, error) {
+		switch v := raw[name].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return strings.Fields(v), nil
+		case []interface{}:
+			list := []string{}
+			for _, s := range v {
+				str, ok := s.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid %s claim", name)
+				}
+				list = append(list, str)
+			}
+			return list, nil
+		default:
+			return nil, fmt.Errorf("invalid %s claim", name)
+		}
+	}
+	c := &claims{}
+	var err error
+	if sub, ok := raw["sub"].(string); ok {
+		c.Subject = sub
+	}
+	if c.Scopes, err = strs("scope"); err != nil {
+		return nil, err
+	}
+	if _, ok := raw["scope"]; !ok {
+		c.Scopes = legacyScopes
+	}
+	ids, err := strs("blob")
+	if err != nil {
+		return nil, err
+	}
+	if ids != nil {
+		c.Blobs = []uuid.UUID{}
+		for _, s := range ids {
+			id, err := uuid.ParseUUID(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blob claim: %v", err)
+			}
+			c.Blobs = append(c.Blobs, id)
+		}
+	}
+	if c.Groups, err = strs("groups"); err != nil {
+		return nil, err
+	}
+	if c.Types, err = strs("content_type"); err != nil {
+		return nil, err
+	}
+	switch v := raw["max_size"].(type) {
+	case nil:
+	case float64:
+		c.MaxSize = int64(v)
+	default:
+		return nil, errors.New("invalid max_size claim")
+	}
+	return c, nil
+}
+
+// hasScope reports whether the claims grant scope
+func (c *claims) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsBlob reports whether the claims allow access to the blob with id.
+// Tokens restricted to blobs are not allowed access to requests for no
+// particular blob, such as uploads and listings.
+func (c *claims) allowsBlob(id uuid.UUID) bool {
+	if c.Blobs == nil {
+		return true
+	}
+	for _, allowed := range c.Blobs {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// principals returns the subject and groups of the claims as they appear in
+// an ACL
+func (c *claims) principals() []string {
+	p := []string{}
+	if c.Subject != "" {
+		p = append(p, c.Subject)
+	}
+	for _, g := range c.Groups {
+		p = append(p, "group:"+g)
+	}
+	return p
+}
+
+// owns reports whether the claims are those of the blob owner or an admin
+func (c *claims) owns(b *blob.Blob) bool {
+	return c.hasScope(scopeAdmin) || b.Owner != "" && c.Subject == b.Owner
+}
+
+// granted reports whether the claims are those of the blob owner, an admin
+// or one of the principals in acl. Blobs without an owner, uploaded before
+// owners were recorded or without a subject, are granted to any token.
+func (c *claims) granted(b *blob.Blob, acl []string) bool {
+	if b.Owner == "" || c.owns(b) {
+		return true
+	}
+	for _, p := range c.principals() {
+		for _, a := range acl {
+			if p == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readers returns the principals the ACL of the blob allows to read it
+func readers(b *blob.Blob) []string {
+	if b.ACL == nil {
+		return nil
+	}
+	return b.ACL.Read
+}
+
+// deleters returns the principals the ACL of the blob allows to delete it
+func deleters(b *blob.Blob) []string {
+	if b.ACL == nil {
+		return nil
+	}
+	return b.ACL.Delete
+}
+
+// allowsType reports whether types allows uploads of contentType. Types are
+// exact content types or prefixes ending in "/" such as "image/", and nil
+// allows any type.
+func allowsType(types []string, contentType string) bool {
+	if types == nil {
+		return true
+	}
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == contentType || strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// unauthorized returns an error reported with a 401 status
+func unauthorized(err error) error {
+	return &statusError{http.StatusUnauthorized, err}
+}
+
+// forbidden returns an error reported with a 403 status
+func forbidden(format string, a ...interface{}) error {
+	return &statusError{http.StatusForbidden, fmt.Errorf(format, a...)}
+}
+
+// Fetch, decode and verify authorization header.
+// The token may be given bare or as a Bearer token.
+func authenticate(r *http.Request) (*claims, error) {
+	if *secretKey == "" && len(currentPublicKeys()) == 0 {
+		return fullAccess, nil // DISABLE AUTH
+	}
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return nil, unauthorized(errors.New("missing token"))
+	}
+	raw, err := verifyToken(token)
+	if err != nil {
+		return nil, unauthorized(err)
+	}
+	c, err := parseClaims(raw)
+	if err != nil {
+		return nil, unauthorized(err)
+	}
+	return c, nil
+}
+
+// authorize checks that the request token grants scope for the blob with
+// id, or for no particular blob if id is invalid
+func authorize(r *http.Request, scope string, id uuid.UUID) (*claims, error) {
+	c, err := authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !c.hasScope(scope) {
+		return nil, forbidden("token does not grant %s scope", scope)
+	}
+	if !c.allowsBlob(id) {
+		if !id.Valid() {
+			return nil, forbidden("token is restricted to specific blobs")
+		}
+		return nil, forbidden("token does not grant access to blob %s", id)
+	}
+	return c, nil
+}
+
+// readableBlob loads the blob addressed by the request path if the request
+// is signed for it or may read it according to --read-auth and the ACL of
+// the blob
+func readableBlob(r *http.Request, matcher *regexp.Regexp) (*blob.Blob, error) {
+	id, err := idFromPath(r, matcher)
+	if err != nil {
+		return nil, err
+	}
+	// A signed URL grants access to the blob in its path
+	if isSigned(r) {
+		if _, _, err := verifySignedURL(r); err != nil {
+			return nil, err
+		}
+		return blob.Get(id)
+	}
+	// Check before loading so missing blobs are not revealed
+	var c *claims
+	if *serverReadAuth == readAuthToken {
+		if c, err = authorize(r, scopeRead, id); err != nil {
+			return nil, err
+		}
+	}
+	b, err := blob.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	// Private blobs with an owner are only readable by the principals the
+	// ACL grants, even when reads are public
+	if b.Private() && (b.Owner != "" || *serverReadAuth == readAuthBlob) {
+		if c == nil {
+			if c, err = authorize(r, scopeRead, id); err != nil {
+				return nil, err
+			}
+		}
+		if !c.granted(b, readers(b)) {
+			return nil, forbidden("token does not grant access to blob %s", id)
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"blob"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// expectedChecksums returns the hex encoded SHA-256 and MD5 checksums a
+// client claims for an upload via the Content-MD5 header, the RFC 3230
+// Digest header or the RFC 9530 Content-Digest and Repr-Digest headers.
+func expectedChecksums(h textproto.MIMEHeader) (sha256Sum, md5Sum string, err error) {
+	set := func(dst *string, alg, b64 string) error {
+		sum, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return fmt.Errorf("invalid %s digest: %v", alg, err)
+		}
+		if *dst != "" && *dst != hex.EncodeToString(sum) {
+			return fmt.Errorf("conflicting %s digests", alg)
+		}
+		*dst = hex.EncodeToString(sum)
+		return nil
+	}
+	if v := h.Get("Content-MD5"); v != "" {
+		if err := set(&md5Sum, "md5", strings.TrimSpace(v)); err != nil {
+			return "", "", err
+		}
+	}
+	for _, name := range []string{"Digest", "Content-Digest", "Repr-Digest"} {
+		for _, v := range h[textproto.CanonicalMIMEHeaderKey(name)] {
+			for _, d := range strings.Split(v, ",") {
+				kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				// RFC 9530 wraps values as byte sequences :value:
+				value := strings.Trim(kv[1], ":")
+				switch strings.ToLower(kv[0]) {
+				case "sha-256":
+					err = set(&sha256Sum, "sha-256", value)
+				case "md5":
+					err = set(&md5Sum, "md5", value)
+				}
+				if err != nil {
+					return "", "", err
+				}
+			}
+		}
+	}
+	return sha256Sum, md5Sum, nil
+}
+
+// setDigestHeaders sets the Digest and Repr-Digest headers for the blob data
+func setDigestHeaders(w http.ResponseWriter, b *blob.Blob) {
+	sum, err := hex.DecodeString(b.SHA256)
+	if err != nil || len(sum) == 0 {
+		return
+	}
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	w.Header().Set("Digest", "SHA-256="+b64)
+	w.Header().Set("Repr-Digest", "sha-256=:"+b64+":")
+}
+
+// etagMatches reports whether tag is in the list of entity tags from an
+// If-Match or If-None-Match header. Weak comparison is used when weak is set.
+func etagMatches(list, tag string, weak bool) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match against tag, the
+// etag of the representation. If the request should not proceed the 304 or
+// 412 response is written and false is returned.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, tag string) bool {
+	if im := r.Header.Get("If-Match"); im != "" && !etagMatches(im, tag, false) {
+		http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, tag, true) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNotModified)
+		} else {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		}
+		return false
+	}
+	return true
+}
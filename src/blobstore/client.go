@@ -0,0 +1,181 @@
+package main
+
+import (
+	"blob"
+	"client"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+	"uuid"
+)
+
+// Seconds that tokens signed by the client are valid for
+const clientTokenExpiry = 60
+
+// newClient returns a client for the endpoint. If a secret key is set
+// requests carry a short lived token signed with it.
+func newClient() *client.Client {
+	c := client.New(*clientAddr)
+	if *secretKey != "" {
+		c.Tokens = client.TokenFunc(func() (string, error) {
+			return jwtEncode(*secretKey, map[string]interface{}{}, clientTokenExpiry)
+		})
+	}
+	return c
+}
+
+// putFilesCommand uploads all the files in a single request and writes the
+// returned blob info to w. The files are streamed so they are never held in
+// memory. The blobs expire after --ttl if set.
+func putFilesCommand(w io.Writer, paths []string) error {
+	uploads := []client.Upload{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		u := client.Upload{
+			Name: filepath.Base(path),
+			Body: f,
+		}
+		if *putTTL > 0 {
+			u.ExpiresAt = time.Now().Add(*putTTL)
+		}
+		uploads = append(uploads, u)
+	}
+	blobs, err := newClient().PutAll(context.Background(), uploads...)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(blobs)
+}
+
+// getCommand streams the blob data to w or the output path
+func getCommand(w io.Writer, id string, output string) (err error) {
+	blobID, err := uuid.ParseUUID(id)
+	if err != nil {
+		return err
+	}
+	data, err := newClient().Get(context.Background(), blobID)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	if output == "" {
+		_, err = io.Copy(w, data)
+		return err
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+	_, err = io.Copy(f, data)
+	return err
+}
+
+// infoCommand writes the blob info json to w
+func infoCommand(w io.Writer, id string) error {
+	blobID, err := uuid.ParseUUID(id)
+	if err != nil {
+		return err
+	}
+	b, err := newClient().Info(context.Background(), blobID)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(b)
+}
+
+// rmCommand deletes the blob with the given id
+func rmCommand(id string) error {
+	blobID, err := uuid.ParseUUID(id)
+	if err != nil {
+		return err
+	}
+	return newClient().Delete(context.Background(), blobID)
+}
+
+// signCommand writes a signed URL to download the blob given by the id arg
+// to w, or a signed URL to upload once if there is no id
+func signCommand(w io.Writer) error {
+	var signed *client.SignedURL
+	var err error
+	if *signID != "" {
+		var blobID uuid.UUID
+		if blobID, err = uuid.ParseUUID(*signID); err != nil {
+			return err
+		}
+		signed, err = newClient().SignDownload(context.Background(), blobID, *signTTL)
+	} else {
+		policy := client.UploadPolicy{MaxSize: *signMaxSize, ContentTypes: *signTypes}
+		signed, err = newClient().SignUpload(context.Background(), policy, *signTTL)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, signed.URL)
+	return err
+}
+
+// parseTimeFlag parses an RFC3339 time or a duration before now
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// lsCommand writes a line for each blob matching the ls flags to w
+func lsCommand(w io.Writer) error {
+	q := blob.Query{
+		ContentType: *lsContentType,
+		NamePrefix:  *lsName,
+		MinSize:     *lsMinSize,
+		MaxSize:     *lsMaxSize,
+		Meta:        *lsMeta,
+	}
+	var err error
+	if q.Since, err = parseTimeFlag(*lsSince); err != nil {
+		return err
+	}
+	if q.Until, err = parseTimeFlag(*lsUntil); err != nil {
+		return err
+	}
+	c := newClient()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for listed := 0; *lsLimit <= 0 || listed < *lsLimit; {
+		if *lsLimit > 0 {
+			q.Limit = *lsLimit - listed
+		}
+		blobs, next, err := c.List(context.Background(), q)
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", b.ID, b.Time().Format(time.RFC3339), b.Size, b.ContentType, b.Name)
+		}
+		listed += len(blobs)
+		if !next.Valid() {
+			break
+		}
+		q.After = next
+	}
+	return tw.Flush()
+}
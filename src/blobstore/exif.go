@@ -0,0 +1,80 @@
+package main
+
+import (
+	"blob"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"uuid"
+)
+
+// stripEXIF reads the JPEG data of an upload and returns it without EXIF
+// and XMP metadata. The checksums expected of the upload are those of the
+// original data, so they are checked here and cleared for the stripped data.
+// If the options ask for it the original is stored as a private blob owned
+// by the uploader, which is returned and linked from the meta of b. JPEGs
+// over blob.MaxStripSize are rejected rather than stored with their metadata.
+func stripEXIF(b *blob.Blob, r io.Reader, opts *uploadOptions) (io.Reader, *blob.Blob, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, blob.MaxStripSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(data)) > blob.MaxStripSize {
+		return nil, nil, &statusError{http.StatusRequestEntityTooLarge, fmt.Errorf("jpeg exceeds the %d bytes metadata can be stripped from", blob.MaxStripSize)}
+	}
+	sha256Sum, md5Sum := sha256.Sum256(data), md5.Sum(data)
+	if b.SHA256 != "" && !strings.EqualFold(b.SHA256, hex.EncodeToString(sha256Sum[:])) ||
+		b.MD5 != "" && !strings.EqualFold(b.MD5, hex.EncodeToString(md5Sum[:])) {
+		return nil, nil, blob.ErrChecksumMismatch
+	}
+	b.SHA256, b.MD5 = "", ""
+	stripped, fields, err := blob.StripJPEG(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.exifMeta {
+		for k, v := range fields {
+			b.Meta[k] = v
+		}
+	}
+	if !opts.keepOriginal {
+		return bytes.NewReader(stripped), nil, nil
+	}
+	original := blob.New()
+	original.Name = b.Name
+	original.ContentType = b.ContentType
+	original.ExpiresAt = b.ExpiresAt
+	original.Visibility = blob.Private
+	original.Owner = b.Owner
+	original.Meta = map[string]string{"stripped": b.ID.String()}
+	if err := original.WriteFrom(bytes.NewReader(data)); err != nil {
+		return nil, nil, err
+	}
+	b.Meta["original"] = original.ID.String()
+	return bytes.NewReader(stripped), original, nil
+}
+
+// deleteBlob deletes b along with the original kept when it was stripped
+func deleteBlob(b *blob.Blob) error {
+	if err := b.Delete(); err != nil {
+		return err
+	}
+	id, err := uuid.ParseUUID(b.Meta["original"])
+	if err != nil {
+		return nil
+	}
+	original, err := blob.Get(id)
+	if err != nil || original.Meta["stripped"] != b.ID.String() {
+		return nil
+	}
+	if err := original.Delete(); err != nil && err != blob.ErrNotFound {
+		return err
+	}
+	return nil
+}
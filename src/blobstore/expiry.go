@@ -0,0 +1,66 @@
+package main
+
+import (
+	"blob"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// parseExpiry returns the expiry time of an upload from an RFC3339 expires_at
+// time or a ttl given as a duration or number of seconds, or nil if neither
+// is set. Expiry times are capped to --max-ttl from now.
+func parseExpiry(expiresAt, ttl string) (*time.Time, error) {
+	var t time.Time
+	switch {
+	case expiresAt != "":
+		var err error
+		if t, err = time.Parse(time.RFC3339, expiresAt); err != nil {
+			return nil, fmt.Errorf("invalid expires_at: %v", err)
+		}
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			secs, serr := strconv.ParseInt(ttl, 10, 64)
+			if serr != nil {
+				return nil, fmt.Errorf("invalid ttl: %v", err)
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		t = time.Now().Add(d)
+	default:
+		return nil, nil
+	}
+	now := time.Now()
+	if !t.After(now) {
+		return nil, errors.New("expiry time must be in the future")
+	}
+	if *serverMaxTTL > 0 && t.After(now.Add(*serverMaxTTL)) {
+		t = now.Add(*serverMaxTTL)
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// reapExpired deletes expired blobs from the store every interval until stop
+// is closed
+func reapExpired(store *blob.Store, interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+		ids, err := store.Reap()
+		for _, id := range ids {
+			fmt.Println("deleted expired blob", id)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reaping expired blobs:", err)
+		}
+	}
+}
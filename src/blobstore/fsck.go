@@ -0,0 +1,69 @@
+package main
+
+import (
+	"blob"
+	"fmt"
+	"io"
+	"path/filepath"
+	"uuid"
+)
+
+var repairModes = map[string]blob.RepairMode{
+	"":           blob.RepairNone,
+	"quarantine": blob.RepairQuarantine,
+	"regenerate": blob.RepairRegenerate,
+}
+
+// fsckCommand checks the state dir and writes a line for each problem found
+// to w. The index is rebuilt if anything was repaired or --reindex is set.
+// An error is returned if any problems were left unrepaired.
+func fsckCommand(w io.Writer) error {
+	disk := blob.NewDiskBackend(*fsckStateDir)
+	found, repaired := 0, 0
+	err := disk.Check(repairModes[*fsckRepair], func(p *blob.Problem) {
+		found++
+		if p.Repair != "" {
+			repaired++
+		}
+		fmt.Fprintln(w, p)
+	})
+	if err != nil {
+		return err
+	}
+	path := *fsckIndex
+	if path == "" {
+		path = filepath.Join(disk.Dir, "index.log")
+	}
+	if *fsckReindex || (repaired > 0 && blob.IndexExists(path)) {
+		idx, err := blob.OpenIndex(path)
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+		if err := idx.Rebuild(disk); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "indexed", idx.Len(), "blobs")
+	}
+	if found > repaired {
+		return fmt.Errorf("%d problems found, %d repaired", found, repaired)
+	}
+	return nil
+}
+
+// migrateCommand moves the blobs in the state dir into the --layout
+// directories, writing the ID of each blob moved to w
+func migrateCommand(w io.Writer) error {
+	disk := blob.NewDiskBackend(*migrateStateDir)
+	disk.Layout = blob.Layout(*migrateLayout)
+	n := 0
+	err := disk.MigrateLayout(func(id uuid.UUID) {
+		n++
+		fmt.Fprintln(w, "moved", id)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "migrated", n, "blobs")
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -21,27 +22,45 @@ func jwtEncode(key string, claims map[string]interface{}, expiry int64) (string,
 	return signedToken, nil
 }
 
-func jwtDecode(key string, signedToken string) (map[string]interface{}, error) {
-	// decode JWT
-	token, err := jwt.Parse(signedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return []byte(key), nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	if !token.Valid {
-		if ve, ok := err.(*jwt.ValidationError); ok {
-			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-				return nil, fmt.Errorf("malformed token")
+// jwtDecode verifies the signed token and returns its claims. keyFunc
+// returns the keys the token may have been signed with, which are tried in
+// turn until one verifies the signature.
+func jwtDecode(signedToken string, keyFunc func(*jwt.Token) ([]interface{}, error)) (map[string]interface{}, error) {
+	var keys []interface{}
+	for i := 0; ; i++ {
+		// decode JWT
+		token, err := jwt.Parse(signedToken, func(token *jwt.Token) (interface{}, error) {
+			if keys == nil {
+				var err error
+				if keys, err = keyFunc(token); err != nil {
+					return nil, err
+				}
+				if len(keys) == 0 {
+					return nil, errors.New("no key to verify token")
+				}
 			}
-			if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-				return nil, fmt.Errorf("token expired")
+			return keys[i], nil
+		})
+		if err == nil && token.Valid {
+			return token.Claims, nil
+		}
+		ve, ok := err.(*jwt.ValidationError)
+		if !ok {
+			return nil, fmt.Errorf("invalid token")
+		}
+		switch {
+		case ve.Errors&jwt.ValidationErrorMalformed != 0:
+			return nil, fmt.Errorf("malformed token")
+		case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+			return nil, errors.New(ve.Error())
+		case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+			if i+1 < len(keys) {
+				continue
 			}
+			return nil, fmt.Errorf("invalid token")
+		case ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0:
+			return nil, fmt.Errorf("token expired")
 		}
 		return nil, fmt.Errorf("invalid token")
 	}
-	return token.Claims, nil
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// publicKey is a key that tokens may be signed with
+type publicKey struct {
+	ID  string      // kid of the key, empty if not known
+	Key interface{} // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// the public keys loaded from --jwt-keys
+var (
+	publicKeysMu sync.RWMutex
+	publicKeys   []publicKey
+)
+
+// currentPublicKeys returns the loaded public keys
+func currentPublicKeys() []publicKey {
+	publicKeysMu.RLock()
+	defer publicKeysMu.RUnlock()
+	return publicKeys
+}
+
+// setPublicKeys replaces the loaded public keys
+func setPublicKeys(keys []publicKey) {
+	publicKeysMu.Lock()
+	defer publicKeysMu.Unlock()
+	publicKeys = keys
+}
+
+// loadPublicKeys reads the public keys in a JWKS file or a file of PEM
+// encoded public keys or certificates. A PEM block may give the kid of its
+// key in a "kid" header.
+func loadPublicKeys(path string) ([]publicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []publicKey
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		keys, err = parseJWKS(data)
+	} else {
+		keys, err = parsePEMKeys(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys found", path)
+	}
+	return keys, nil
+}
+
+// parsePEMKeys reads the public keys from PEM blocks
+func parsePEMKeys(data []byte) ([]publicKey, error) {
+	keys := []publicKey{}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported %T public key", key)
+		}
+		keys = append(keys, publicKey{ID: block.Headers["kid"], Key: key})
+	}
+	return keys, nil
+}
+
+// jwk is a JSON Web Key as found in a JWKS file
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the RSA and EC signing keys of a JWKS document. Keys of
+// other types or for other uses are skipped.
+func parseJWKS(data []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := []publicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaKey()
+		case "EC":
+			key, err = k.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		keys = append(keys, publicKey{ID: k.Kid, Key: key})
+	}
+	return keys, nil
+}
+
+// rsaKey returns the RSA public key described by the n and e parameters
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := jwkInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := jwkInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+// ecKey returns the ECDSA public key described by the crv, x and y parameters
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := jwkInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := jwkInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// jwkInt decodes a base64url encoded big-endian integer parameter
+func jwkInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// reloadPublicKeys loads the keys in path again each time the process
+// receives a SIGHUP, so signing keys can be rotated without a restart. The
+// previous keys are kept if the file cannot be loaded.
+func reloadPublicKeys(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		keys, err := loadPublicKeys(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reloading public keys:", err)
+			continue
+		}
+		setPublicKeys(keys)
+		fmt.Println("loaded", len(keys), "public keys")
+	}
+}
+
+// tokenKeys returns the keys that may verify the token: the secret for HMAC
+// signed tokens, otherwise the public keys of the matching type, narrowed to
+// the key with the token's kid if it has one.
+func tokenKeys(token *jwt.Token) ([]interface{}, error) {
+	match := func(key interface{}) bool { return false }
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if *secretKey == "" {
+			return nil, errors.New("HMAC signed tokens are not accepted")
+		}
+		return []interface{}{[]byte(*secretKey)}, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		match = func(key interface{}) bool {
+			_, ok := key.(*rsa.PublicKey)
+			return ok
+		}
+	case *jwt.SigningMethodECDSA:
+		match = func(key interface{}) bool {
+			_, ok := key.(*ecdsa.PublicKey)
+			return ok
+		}
+	default:
+		return nil, fmt.Errorf("unexpected signing method")
+	}
+	kid, _ := token.Header["kid"].(string)
+	keys := []interface{}{}
+	for _, k := range currentPublicKeys() {
+		if match(k.Key) && (kid == "" || k.ID == kid) {
+			keys = append(keys, k.Key)
+		}
+	}
+	if len(keys) == 0 {
+		if kid != "" {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return nil, fmt.Errorf("no key for %s signed tokens", token.Method.Alg())
+	}
+	return keys, nil
+}
+
+// verifyToken checks the signature of the token and that it was issued by
+// --jwt-issuer for --jwt-audience if they are set, and returns its claims
+func verifyToken(signedToken string) (map[string]interface{}, error) {
+	raw, err := jwtDecode(signedToken, tokenKeys)
+	if err != nil {
+		return nil, err
+	}
+	if *serverJWTIssuer != "" {
+		if iss, _ := raw["iss"].(string); iss != *serverJWTIssuer {
+			return nil, errors.New("token has the wrong issuer")
+		}
+	}
+	if *serverJWTAudience != "" && !hasAudience(raw["aud"], *serverJWTAudience) {
+		return nil, errors.New("token has the wrong audience")
+	}
+	return raw, nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array of
+// strings, includes audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -4,7 +4,10 @@ import (
 	"blob"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/alecthomas/kingpin"
 )
@@ -16,31 +19,231 @@ var (
 	secretKey  = cli.Flag("secret", "Secret key used during authentication").Default("").String()
 	clientAddr = cli.Flag("endpoint", "Address and port to connect to when in client mode").Default("http://blobstore.kiloe.net").String()
 
-	server             = cli.Command("start", "Start HTTP API service")
-	serverAddr         = server.Flag("listen", "Address and port to listen on").Default(":7000").String()
-	serverStateDir     = server.Flag("state", "Path to state dir where blobs will be stored").Default("/var/state").ExistingDir()
-	serverMaxUploadMem = server.Flag("max-memory", "Megabytes allowed for file uploads before buffering to disk").Default("32").Int64()
-	serverMaxBlobSize  = server.Flag("max-size", "Megabyte limit on blob size").Default("128").Int64()
+	server               = cli.Command("start", "Start HTTP API service")
+	serverAddr           = server.Flag("listen", "Address and port to listen on").Default(":7000").String()
+	serverStateDir       = server.Flag("state", "Path to state dir where blobs will be stored").Default("/var/state").ExistingDir()
+	serverBackend        = server.Flag("backend", "URL of storage backend (s3://KEY:SECRET@HOST/BUCKET/PREFIX), defaults to the state dir").Default("").String()
+	serverMaxBlobSize    = server.Flag("max-size", "Megabyte limit on blob size, 0 for no limit").Default("128").Int64()
+	serverMaxUploadMem   = server.Flag("max-memory", "Deprecated and ignored, uploads are streamed").Hidden().Int64()
+	serverDedup          = server.Flag("dedup", "Store identical blob data only once (local state dir only)").Bool()
+	serverReadAuth       = server.Flag("read-auth", "Who can download blobs: anyone (public), token holders (token) or anyone but private blobs without an owner need a token (blob). Private blobs with an owner are only readable by the owner and their ACL in every mode").Default("public").Enum("public", "token", "blob")
+	serverLayout         = server.Flag("layout", "Directory layout new blobs are written in (date|hash), existing blobs are found in either").Default("date").Enum("date", "hash")
+	serverIndex          = server.Flag("index", "Path to metadata index file, defaults to index.log in the state dir").Default("").String()
+	serverMaxTTL         = server.Flag("max-ttl", "Longest time to live that uploads may set, 0 for no limit").Default("0").Duration()
+	serverReap           = server.Flag("reap-interval", "How often to delete expired blobs, 0 to disable").Default("1m").Duration()
+	serverScrub          = server.Flag("scrub-interval", "How often to re-verify the checksum of each blob, 0 to disable").Default("168h").Duration()
+	serverScrubRate      = server.Flag("scrub-rate", "Megabytes per second the scrubber may read, 0 for no limit").Default("10").Int64()
+	serverRejectMismatch = server.Flag("reject-mismatch", "Reject uploads whose content does not match their claimed content type instead of storing the detected type").Bool()
+	serverAllowTypes     = server.Flag("allow-type", "Content type, or prefix such as image/, that uploads may have, repeatable, defaults to any").Strings()
+	serverStripEXIF      = server.Flag("strip-exif", "Remove EXIF and XMP metadata such as GPS coordinates from JPEG uploads, unless an upload sets strip_exif=false").Bool()
+	serverThumbMax       = server.Flag("thumbnail-max", "Largest width or height images may be resized to with the w and h parameters, 0 to disable resizing").Default("2048").Int()
+	serverThumbSizes     = server.Flag("thumbnail-size", "Width or height that images may be resized to, repeatable, defaults to 64, 128, 256, 512 and 1024").Ints()
+	serverPresets        = server.Flag("preset", "Named rendition of images served at /{id}/{name} as name=w=W,h=H,fit=FIT,fmt=FMT with the parameters of resized downloads, repeatable").StringMap()
+	serverRenderWorkers  = server.Flag("render-workers", "Number of workers generating the renditions of presets after upload, 0 to only generate them on first request").Default("2").Int()
+	serverJWTKeys        = server.Flag("jwt-keys", "Path to a PEM or JWKS file of public keys that RS*, PS* and ES* tokens may be signed with, reloaded on SIGHUP").Default("").String()
+	serverJWTIssuer      = server.Flag("jwt-issuer", "Only accept tokens with this iss claim").Default("").String()
+	serverJWTAudience    = server.Flag("jwt-audience", "Only accept tokens with this aud claim").Default("").String()
 
-	put      = cli.Command("put", "Store file in the blobstore")
-	putFiles = put.Arg("files", "Path to upload to blobstore").Required().ExistingFile()
+	put      = cli.Command("put", "Store files in the blobstore")
+	putFiles = put.Arg("files", "Paths to upload to blobstore").Required().ExistingFiles()
+	putTTL   = put.Flag("ttl", "Delete the blobs after this long, eg 24h").Duration()
 
-	get   = cli.Command("get", "Fetch blob data by ID")
-	getID = get.Arg("id", "ID of blob to fetch").Required().String()
+	get       = cli.Command("get", "Fetch blob data by ID")
+	getID     = get.Arg("id", "ID of blob to fetch").Required().String()
+	getOutput = get.Flag("output", "Path to write blob data to instead of stdout").Short('o').String()
 
 	info   = cli.Command("info", "Fetch blob info by ID")
 	infoID = info.Arg("id", "ID of blob to fetch info for").Required().String()
+
+	rm   = cli.Command("rm", "Delete blob by ID")
+	rmID = rm.Arg("id", "ID of blob to delete").Required().String()
+
+	ls            = cli.Command("ls", "List blobs")
+	lsContentType = ls.Flag("type", "Only list blobs of this content type, or prefix such as image/").String()
+	lsName        = ls.Flag("name", "Only list blobs with filenames starting with this prefix").String()
+	lsMinSize     = ls.Flag("min-size", "Only list blobs of at least this many bytes").Int64()
+	lsMaxSize     = ls.Flag("max-size", "Only list blobs of at most this many bytes").Int64()
+	lsSince       = ls.Flag("since", "Only list blobs created since this RFC3339 time or duration ago").String()
+	lsUntil       = ls.Flag("until", "Only list blobs created before this RFC3339 time or duration ago").String()
+	lsMeta        = ls.Flag("meta", "Only list blobs with this meta key=value").StringMap()
+	lsLimit       = ls.Flag("limit", "Maximum number of blobs to list, 0 for all").Default("100").Int()
+
+	token         = cli.Command("token", "Mint an access token signed with the secret key")
+	tokenExpiry   = token.Flag("expiry", "How long the token is valid for").Default("1h").Duration()
+	tokenScopes   = token.Flag("scope", "Scope to grant (read|write|delete|admin|original), repeatable, defaults to read, write and delete").Enums(scopeRead, scopeWrite, scopeDelete, scopeAdmin, scopeOriginal)
+	tokenTypes    = token.Flag("type", "Content type that may be uploaded, or prefix such as image/, repeatable, defaults to any").Strings()
+	tokenMaxSize  = token.Flag("max-size", "Byte limit on the size of each uploaded blob, 0 for the server limit").Int64()
+	tokenBlob     = token.Flag("blob", "Only grant access to the blob with this ID").String()
+	tokenSubject  = token.Flag("subject", "Subject (sub claim) identifying the token holder, recorded as the owner of uploads").String()
+	tokenGroups   = token.Flag("group", "Group (groups claim) of the token holder for blob ACLs, repeatable").Strings()
+	tokenIssuer   = token.Flag("issuer", "Issuer (iss claim) expected by the server's --jwt-issuer").String()
+	tokenAudience = token.Flag("audience", "Audience (aud claim) expected by the server's --jwt-audience").String()
+
+	sign        = cli.Command("sign", "Create a pre-signed URL to download a blob, or to upload once if no ID is given")
+	signID      = sign.Arg("id", "ID of blob to sign a download URL for").String()
+	signTTL     = sign.Flag("ttl", "How long the URL is valid for, defaults to the server default").Duration()
+	signMaxSize = sign.Flag("max-size", "Byte limit on the size of the uploaded blob").Int64()
+	signTypes   = sign.Flag("type", "Content type that may be uploaded, or prefix such as image/, repeatable").Strings()
+
+	migrate         = cli.Command("migrate-layout", "Move blobs in the state dir into a new directory layout, safe while the server is running")
+	migrateStateDir = migrate.Flag("state", "Path to state dir to migrate").Default("/var/state").ExistingDir()
+	migrateLayout   = migrate.Flag("layout", "Directory layout to move blobs into (date|hash)").Required().Enum("date", "hash")
+
+	fsck         = cli.Command("fsck", "Check the state dir for inconsistencies, the server must be stopped before repairing")
+	fsckStateDir = fsck.Flag("state", "Path to state dir to check").Default("/var/state").ExistingDir()
+	fsckRepair   = fsck.Flag("repair", "Repair problems by quarantining files or regenerating metadata from blob data where possible (quarantine|regenerate)").Enum("quarantine", "regenerate")
+	fsckReindex  = fsck.Flag("reindex", "Rebuild the metadata index, done automatically after repairs").Bool()
+	fsckIndex    = fsck.Flag("index", "Path to metadata index file, defaults to index.log in the state dir").Default("").String()
 )
 
 const (
 	MB = 1000000
 )
 
+// openBackend returns the storage backend described by rawurl, falling back
+// to the state dir when empty. S3 credentials and region not given in the
+// url are taken from the standard AWS environment variables.
+func openBackend(rawurl string) (blob.Backend, error) {
+	diskBackend := func(dir string) blob.Backend {
+		disk := blob.NewDiskBackend(dir)
+		disk.Layout = blob.Layout(*serverLayout)
+		disk.Dedup = *serverDedup
+		return disk
+	}
+	if rawurl == "" {
+		return diskBackend(*serverStateDir), nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if *serverDedup && u.Scheme != "file" {
+		return nil, errors.New("--dedup is only supported for the local state dir")
+	}
+	switch u.Scheme {
+	case "file":
+		return diskBackend(u.Path), nil
+	case "s3":
+		s3, err := blob.NewS3Backend(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		s3.Layout = blob.Layout(*serverLayout)
+		if s3.AccessKey == "" {
+			s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+			s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		if region := os.Getenv("AWS_REGION"); region != "" && u.Query().Get("region") == "" {
+			s3.Region = region
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unsupported backend %q", rawurl)
+	}
+}
+
+// openIndex opens the metadata index for backend, rebuilding it from the
+// backend if it does not exist yet. Backends without a local state dir and
+// no --index path use an in-memory index rebuilt on every start.
+func openIndex(backend blob.Backend) (*blob.Index, error) {
+	path := *serverIndex
+	if disk, ok := backend.(*blob.DiskBackend); ok && path == "" {
+		path = filepath.Join(disk.Dir, "index.log")
+	}
+	idx := blob.NewIndex()
+	rebuild := true
+	if path != "" {
+		rebuild = !blob.IndexExists(path)
+		var err error
+		if idx, err = blob.OpenIndex(path); err != nil {
+			return nil, err
+		}
+	}
+	if !rebuild {
+		return idx, nil
+	}
+	fmt.Println("rebuilding metadata index")
+	if err := idx.Rebuild(backend); err != nil {
+		return nil, err
+	}
+	fmt.Println("indexed", idx.Len(), "blobs")
+	return idx, nil
+}
+
 func Main() error {
 	switch kingpin.MustParse(cli.Parse(os.Args[1:])) {
 	case server.FullCommand():
-		blob.StateDir = *serverStateDir
+		backend, err := openBackend(*serverBackend)
+		if err != nil {
+			return err
+		}
+		store := blob.NewStore(backend)
+		idx, err := openIndex(backend)
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+		store.SetIndex(idx)
+		blob.DefaultStore = store
+		if *serverJWTKeys != "" {
+			keys, err := loadPublicKeys(*serverJWTKeys)
+			if err != nil {
+				return err
+			}
+			setPublicKeys(keys)
+			go reloadPublicKeys(*serverJWTKeys)
+		}
+		if presets, err = parsePresets(*serverPresets); err != nil {
+			return err
+		}
+		// Background tasks are stopped, and waited for, before the index
+		// they update is closed if the server fails
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		defer close(stop)
+		background := func(task func()) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				task()
+			}()
+		}
+		if *serverRenderWorkers > 0 && len(presets) > 0 {
+			renderQueue = startRenderers(*serverRenderWorkers, stop, &wg)
+			background(func() { queueStale(store, stop) })
+		}
+		if *serverReap > 0 {
+			background(func() { reapExpired(store, *serverReap, stop) })
+		}
+		if *serverScrub > 0 {
+			scrubber = &blob.Scrubber{
+				Store:    store,
+				Interval: *serverScrub,
+				Rate:     *serverScrubRate * MB,
+			}
+			background(func() { scrubber.Run(stop) })
+		}
 		return ListenAndServe(*serverAddr)
+	case put.FullCommand():
+		return putFilesCommand(os.Stdout, *putFiles)
+	case get.FullCommand():
+		return getCommand(os.Stdout, *getID, *getOutput)
+	case info.FullCommand():
+		return infoCommand(os.Stdout, *infoID)
+	case rm.FullCommand():
+		return rmCommand(*rmID)
+	case ls.FullCommand():
+		return lsCommand(os.Stdout)
+	case token.FullCommand():
+		return tokenCommand(os.Stdout)
+	case sign.FullCommand():
+		return signCommand(os.Stdout)
+	case migrate.FullCommand():
+		return migrateCommand(os.Stdout)
+	case fsck.FullCommand():
+		return fsckCommand(os.Stdout)
 	default:
 		return errors.New("not implemented")
 	}
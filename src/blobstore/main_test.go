@@ -3,14 +3,36 @@ package main
 import (
 	"blob"
 	"bytes"
+	"client"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"image"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+	"uuid"
+
+	"github.com/dgrijalva/jwt-go"
 )
 
 const endpoint = "http://localhost:7000/"
@@ -113,3 +135,1470 @@ func TestUploadAndDownload(t *testing.T) {
 	}
 
 }
+
+// testUpload uploads the file at path and returns the created blob
+func testUpload(t *testing.T, path string) *blob.Blob {
+	req, err := multipartRequest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("200 expected got: %d", res.StatusCode)
+	}
+	var blobs []*blob.Blob
+	if err := json.NewDecoder(res.Body).Decode(&blobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 {
+		t.Fatal("expected one blob info response json")
+	}
+	return blobs[0]
+}
+
+// withMemoryStore replaces the default store with an empty memory store
+// for the duration of the test
+func withMemoryStore(t *testing.T) *blob.Store {
+	store := blob.DefaultStore
+	t.Cleanup(func() { blob.DefaultStore = store })
+	blob.DefaultStore = blob.NewStore(blob.NewMemoryBackend())
+	return blob.DefaultStore
+}
+
+func TestDelete(t *testing.T) {
+	b := testUpload(t, "test.jpg")
+	del := func() int {
+		req, err := http.NewRequest("DELETE", endpoint+b.ID.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := del(); code != 204 {
+		t.Fatalf("204 expected got: %d", code)
+	}
+	res, err := http.Get(endpoint + b.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("404 expected for deleted blob got: %d", res.StatusCode)
+	}
+	if code := del(); code != 404 {
+		t.Fatalf("404 expected deleting twice got: %d", code)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	b := testUpload(t, "test.jpg")
+	for _, path := range []string{b.ID.String() + ".json", b.ID.String() + "/info"} {
+		res, err := http.Get(endpoint + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("200 expected got: %d", res.StatusCode)
+		}
+		var info blob.Blob
+		if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		if info.ID != b.ID || info.Name != "test.jpg" || info.Size != b.Size {
+			t.Fatalf("expected info to match uploaded blob\ngot: %+v", info)
+		}
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	defer func(addr string) { *clientAddr = addr }(*clientAddr)
+	*clientAddr = endpoint
+	var out bytes.Buffer
+	if err := putFilesCommand(&out, []string{"test.jpg", "test.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	var blobs []*blob.Blob
+	if err := json.NewDecoder(&out).Decode(&blobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 2 {
+		t.Fatalf("expected two blobs got: %d", len(blobs))
+	}
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "test.jpg")
+	if err := getCommand(ioutil.Discard, blobs[0].ID.String(), output); err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadFile("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(original, downloaded) {
+		t.Fatal("expected downloaded bytes to equal original bytes")
+	}
+	if err := rmCommand(blobs[1].ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := infoCommand(ioutil.Discard, blobs[1].ID.String()); err == nil {
+		t.Fatal("expected info of removed blob to fail")
+	}
+}
+
+func TestHead(t *testing.T) {
+	b := testUpload(t, "test.jpg")
+	res, err := http.Head(endpoint + b.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("200 expected got: %d", res.StatusCode)
+	}
+	if res.ContentLength != b.Size {
+		t.Fatalf("expected Content-Length %d got: %d", b.Size, res.ContentLength)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Fatal("expected image/jpeg content type\ngot: " + ct)
+	}
+	if res.Header.Get("ETag") == "" || res.Header.Get("Last-Modified") == "" {
+		t.Fatalf("expected ETag and Last-Modified headers got: %v", res.Header)
+	}
+	res, err = http.Head(endpoint + uuid.TimeUUID().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("404 expected for missing blob got: %d", res.StatusCode)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(store *blob.Store) { blob.DefaultStore = store }(blob.DefaultStore)
+	blob.DefaultStore = blob.NewStore(blob.NewDiskBackend(dir))
+	defer func(size int64) { *serverMaxBlobSize = size }(*serverMaxBlobSize)
+	*serverMaxBlobSize = 1
+	// A small file that fits followed by one over the limit
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	part, err := w.CreateFormFile("file", "small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("small"))
+	part, err = w.CreateFormFile("file", "large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(make([]byte, MB+1))
+	w.Close()
+	res, err := http.Post(endpoint, w.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("413 expected got: %d", res.StatusCode)
+	}
+	// Nothing should be left in the state dir apart from the pideon holes
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("unexpected file left after rejected upload: %s", path)
+		}
+		return nil
+	})
+}
+
+// checksumRequest returns an upload request for data with extra part headers
+func checksumRequest(data []byte, header textproto.MIMEHeader) (*http.Request, error) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="hello.txt"`)
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(data)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
+
+func TestChecksums(t *testing.T) {
+	data := []byte("hello world")
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	b64MD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	b64SHA256 := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	tests := []struct {
+		header textproto.MIMEHeader
+		code   int
+	}{
+		{textproto.MIMEHeader{"Content-Md5": {b64MD5}}, 200},
+		{textproto.MIMEHeader{"Digest": {"SHA-256=" + b64SHA256 + ",MD5=" + b64MD5}}, 200},
+		{textproto.MIMEHeader{"Repr-Digest": {"sha-256=:" + b64SHA256 + ":"}}, 200},
+		{textproto.MIMEHeader{"Content-Md5": {b64SHA256[:24]}}, 400},
+		{textproto.MIMEHeader{"Digest": {"SHA-256=" + b64MD5}}, 400},
+	}
+	var uploaded *blob.Blob
+	for _, test := range tests {
+		req, err := checksumRequest(data, test.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.code {
+			t.Fatalf("%d expected for %v got: %d", test.code, test.header, res.StatusCode)
+		}
+		if res.StatusCode == 200 {
+			var blobs []*blob.Blob
+			if err := json.NewDecoder(res.Body).Decode(&blobs); err != nil {
+				t.Fatal(err)
+			}
+			uploaded = blobs[0]
+		}
+		res.Body.Close()
+	}
+	// Download carries strong ETag and digests
+	res, err := http.Get(endpoint + uploaded.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	tag := `"` + hex.EncodeToString(sha256Sum[:]) + `"`
+	if res.Header.Get("ETag") != tag {
+		t.Fatalf("expected ETag %s got: %s", tag, res.Header.Get("ETag"))
+	}
+	if res.Header.Get("Repr-Digest") != "sha-256=:"+b64SHA256+":" || res.Header.Get("Digest") != "SHA-256="+b64SHA256 {
+		t.Fatalf("unexpected digest headers: %v", res.Header)
+	}
+	// Conditional requests
+	conditional := []struct {
+		method, header, value string
+		code                  int
+	}{
+		{"GET", "If-None-Match", tag, 304},
+		{"HEAD", "If-None-Match", tag, 304},
+		{"GET", "If-None-Match", `"other"`, 200},
+		{"GET", "If-Match", `"other"`, 412},
+		{"HEAD", "If-Match", `"other"`, 412},
+		{"DELETE", "If-Match", `"other"`, 412},
+		{"DELETE", "If-Match", tag, 204},
+	}
+	for _, c := range conditional {
+		req, err := http.NewRequest(c.method, endpoint+uploaded.ID.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(c.header, c.value)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.code {
+			t.Fatalf("%d expected for %s with %s: %s got: %d", c.code, c.method, c.header, c.value, res.StatusCode)
+		}
+	}
+}
+
+func TestDedupReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(store *blob.Store) { blob.DefaultStore = store }(blob.DefaultStore)
+	disk := blob.NewDiskBackend(dir)
+	disk.Dedup = true
+	blob.DefaultStore = blob.NewStore(disk)
+	fi, err := os.Stat("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUpload(t, "test.jpg")
+	testUpload(t, "test.jpg")
+	res, err := http.Get(endpoint + "admin/dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("200 expected got: %d", res.StatusCode)
+	}
+	var stats blob.DedupStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	size := fi.Size()
+	exp := blob.DedupStats{
+		Objects:      1,
+		References:   2,
+		StoredBytes:  size,
+		LogicalBytes: 2 * size,
+		SavedBytes:   size,
+	}
+	if stats != exp {
+		t.Fatalf("expected %+v got: %+v", exp, stats)
+	}
+}
+
+func TestList(t *testing.T) {
+	withMemoryStore(t)
+	res, err := http.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("501 expected without an index got: %d", res.StatusCode)
+	}
+	blob.DefaultStore.SetIndex(blob.NewIndex())
+	a := testUpload(t, "test.jpg")
+	b := testUpload(t, "test.jpg")
+	res, err = http.Get(endpoint + "?content_type=image/&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("200 expected got: %d", res.StatusCode)
+	}
+	var page struct {
+		Blobs []*blob.Blob
+		Next  string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Blobs) != 1 || page.Blobs[0].ID != a.ID || page.Next != a.ID.String() {
+		t.Fatalf("expected first page to contain only %s got: %+v", a.ID, page)
+	}
+	defer func(addr string) { *clientAddr = addr }(*clientAddr)
+	*clientAddr = endpoint
+	var out bytes.Buffer
+	if err := lsCommand(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), a.ID.String()) || !strings.Contains(out.String(), b.ID.String()) {
+		t.Fatalf("expected ls output to list both blobs got: %s", out.String())
+	}
+}
+
+func TestCorruptDownload(t *testing.T) {
+	withMemoryStore(t)
+	b := testUpload(t, "test.jpg")
+	blob.DefaultStore.Backend().Put(b.ID, bytes.NewReader([]byte("corrupted")))
+	b, err := blob.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Verify(); err != blob.ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt got: %v", err)
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		req, _ := http.NewRequest(method, endpoint+b.ID.String(), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("500 expected for %s of corrupt blob got: %d", method, res.StatusCode)
+		}
+	}
+	res, err := http.Get(endpoint + "admin/scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("404 expected with scrubbing disabled got: %d", res.StatusCode)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	withMemoryStore(t)
+	defer func(max time.Duration) { *serverMaxTTL = max }(*serverMaxTTL)
+	*serverMaxTTL = time.Hour
+	upload := func(field, value string) (*blob.Blob, int) {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		w.WriteField(field, value)
+		part, _ := w.CreateFormFile("file", "temp.txt")
+		part.Write([]byte("temporary"))
+		w.Close()
+		res, err := http.Post(endpoint, w.FormDataContentType(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var blobs []*blob.Blob
+		json.NewDecoder(res.Body).Decode(&blobs)
+		if len(blobs) == 0 {
+			return nil, res.StatusCode
+		}
+		return blobs[0], res.StatusCode
+	}
+	if _, code := upload("expires_at", time.Now().Add(-time.Hour).Format(time.RFC3339)); code != 400 {
+		t.Fatalf("400 expected for expiry in the past got: %d", code)
+	}
+	b, code := upload("ttl", "48h")
+	if code != 200 {
+		t.Fatalf("200 expected got: %d", code)
+	}
+	if b.ExpiresAt == nil || b.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expected expiry to be capped to an hour got: %v", b.ExpiresAt)
+	}
+	res, err := http.Get(endpoint + b.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Expires") == "" {
+		t.Fatalf("200 with Expires header expected got: %d %q", res.StatusCode, res.Header.Get("Expires"))
+	}
+	// Expire it
+	past := time.Now().Add(-time.Minute)
+	b.ExpiresAt = &past
+	data, _ := json.Marshal(b)
+	blob.DefaultStore.Backend().WriteMeta(b.ID, data)
+	for _, path := range []string{b.ID.String(), b.ID.String() + ".json"} {
+		res, err := http.Get(endpoint + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusGone {
+			t.Fatalf("410 expected for expired %s got: %d", path, res.StatusCode)
+		}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		reapExpired(blob.DefaultStore, time.Millisecond, stop)
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		if _, err := blob.DefaultStore.Backend().ReadMeta(b.ID); err == blob.ErrNotFound {
+			break
+		} else if i == 1000 {
+			t.Fatalf("expected expired blob to be reaped got: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected reaper to return once stopped")
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	withMemoryStore(t)
+	defer func(key, mode string) { *secretKey, *serverReadAuth = key, mode }(*secretKey, *serverReadAuth)
+	*secretKey = "test-secret"
+	token := func(claims map[string]interface{}) string {
+		s, err := jwtEncode(*secretKey, claims, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + s
+	}
+	do := func(method, path, auth string, body []byte, header http.Header) *http.Response {
+		req, err := http.NewRequest(method, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	upload := func(auth string, size int, header http.Header) (*blob.Blob, int) {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		part, _ := w.CreateFormFile("file", "secret.txt")
+		part.Write(make([]byte, size))
+		w.Close()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Content-Type", w.FormDataContentType())
+		res := do("POST", "", auth, body.Bytes(), header)
+		defer res.Body.Close()
+		var blobs []*blob.Blob
+		json.NewDecoder(res.Body).Decode(&blobs)
+		if len(blobs) == 0 {
+			return nil, res.StatusCode
+		}
+		return blobs[0], res.StatusCode
+	}
+	writer := token(map[string]interface{}{"scope": "write"})
+	reader := token(map[string]interface{}{"scope": []string{"read"}})
+	// Uploads
+	if _, code := upload("", 10, nil); code != http.StatusUnauthorized {
+		t.Fatalf("401 expected without token got: %d", code)
+	}
+	if _, code := upload("Bearer garbage", 10, nil); code != http.StatusUnauthorized {
+		t.Fatalf("401 expected with invalid token got: %d", code)
+	}
+	if _, code := upload(reader, 10, nil); code != http.StatusForbidden {
+		t.Fatalf("403 expected without write scope got: %d", code)
+	}
+	if _, code := upload(token(map[string]interface{}{"scope": "write", "max_size": 5}), 10, nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("413 expected over max_size claim got: %d", code)
+	}
+	public, code := upload(writer, 10, nil)
+	if code != 200 {
+		t.Fatalf("200 expected with write scope got: %d", code)
+	}
+	if _, code := upload(writer, 10, http.Header{"X-Visibility": {"private"}}); code != http.StatusForbidden {
+		t.Fatalf("403 expected uploading private blob without a subject to own it got: %d", code)
+	}
+	private, code := upload(token(map[string]interface{}{"scope": "write", "sub": "alice"}), 10, http.Header{"X-Visibility": {"private"}})
+	if code != 200 || !private.Private() {
+		t.Fatalf("200 expected uploading private blob got: %d %+v", code, private)
+	}
+	// Private blobs from before owners were recorded
+	legacy := blob.New()
+	legacy.Visibility = blob.Private
+	if err := legacy.WriteFrom(strings.NewReader("legacy")); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := upload(token(map[string]interface{}{}), 10, nil); code != 200 {
+		t.Fatalf("200 expected with legacy token without scope got: %d", code)
+	}
+	// Reads in each mode
+	only := func(id uuid.UUID) string {
+		return token(map[string]interface{}{"scope": "read", "blob": id.String()})
+	}
+	cases := []struct {
+		mode string
+		b    *blob.Blob
+		auth string
+		code int
+	}{
+		{readAuthPublic, private, "", http.StatusUnauthorized},
+		{readAuthPublic, private, reader, http.StatusForbidden},
+		{readAuthPublic, private, token(map[string]interface{}{"scope": "read", "sub": "alice"}), 200},
+		{readAuthPublic, legacy, "", 200},
+		{readAuthToken, public, "", http.StatusUnauthorized},
+		{readAuthToken, public, writer, http.StatusForbidden},
+		{readAuthToken, public, reader, 200},
+		{readAuthToken, public, only(public.ID), 200},
+		{readAuthToken, public, only(private.ID), http.StatusForbidden},
+		{readAuthBlob, public, "", 200},
+		{readAuthBlob, private, reader, http.StatusForbidden},
+		{readAuthBlob, legacy, "", http.StatusUnauthorized},
+		{readAuthBlob, legacy, reader, 200},
+	}
+	for _, c := range cases {
+		*serverReadAuth = c.mode
+		for _, path := range []string{c.b.ID.String(), c.b.ID.String() + ".json"} {
+			res := do("GET", path, c.auth, nil, nil)
+			res.Body.Close()
+			if res.StatusCode != c.code {
+				t.Fatalf("%d expected for %s read of %s got: %d", c.code, c.mode, path, res.StatusCode)
+			}
+			if c.code == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("expected WWW-Authenticate header with 401")
+			}
+		}
+	}
+	// Listing requires a read token for any blob
+	for auth, code := range map[string]int{reader: 200, only(public.ID): http.StatusForbidden, "": http.StatusUnauthorized} {
+		res := do("GET", "", auth, nil, nil)
+		res.Body.Close()
+		if res.StatusCode != code && res.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("%d expected listing got: %d", code, res.StatusCode)
+		}
+	}
+	// Deletes
+	res := do("DELETE", public.ID.String(), writer, nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("403 expected deleting without delete scope got: %d", res.StatusCode)
+	}
+	res = do("DELETE", public.ID.String(), token(map[string]interface{}{"scope": "delete"}), nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("204 expected deleting with delete scope got: %d", res.StatusCode)
+	}
+	// Admin endpoints
+	res = do("GET", "admin/scrub", writer, nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("403 expected for admin endpoint without admin scope got: %d", res.StatusCode)
+	}
+	res = do("GET", "admin/scrub", token(map[string]interface{}{"scope": "admin"}), nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("404 expected for disabled scrubber with admin scope got: %d", res.StatusCode)
+	}
+}
+
+func TestPublicKeyTokens(t *testing.T) {
+	defer func(key, iss, aud string) {
+		*secretKey, *serverJWTIssuer, *serverJWTAudience = key, iss, aud
+		setPublicKeys(nil)
+	}(*secretKey, *serverJWTIssuer, *serverJWTAudience)
+	*secretKey = ""
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, kid string, claims map[string]interface{}) string {
+		token := jwt.New(method)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		for k, v := range claims {
+			token.Claims[k] = v
+		}
+		token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	// A PEM file with a kid header and a JWKS file of the EC key
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemPath := filepath.Join(dir, "keys.pem")
+	ioutil.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": "rsa1"}, Bytes: der}), 0644)
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwksPath := filepath.Join(dir, "keys.json")
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec1", "use": "sig", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "oct", "kid": "skipped", "k": "c2VjcmV0"},
+	}})
+	ioutil.WriteFile(jwksPath, jwks, 0644)
+	pemKeys, err := loadPublicKeys(pemPath)
+	if err != nil || len(pemKeys) != 1 || pemKeys[0].ID != "rsa1" {
+		t.Fatalf("expected one PEM key with kid rsa1 got: %v %v", pemKeys, err)
+	}
+	jwksKeys, err := loadPublicKeys(jwksPath)
+	if err != nil || len(jwksKeys) != 1 || jwksKeys[0].ID != "ec1" {
+		t.Fatalf("expected one JWKS key with kid ec1 got: %v %v", jwksKeys, err)
+	}
+	setPublicKeys(append(pemKeys, jwksKeys...))
+	cases := []struct {
+		desc  string
+		token string
+		ok    bool
+	}{
+		{"RS256", sign(jwt.SigningMethodRS256, rsaKey, "rsa1", nil), true},
+		{"RS256 without kid", sign(jwt.SigningMethodRS256, rsaKey, "", nil), true},
+		{"PS256", sign(jwt.SigningMethodPS256, rsaKey, "rsa1", nil), true},
+		{"ES256", sign(jwt.SigningMethodES256, ecKey, "ec1", nil), true},
+		{"unknown kid", sign(jwt.SigningMethodRS256, rsaKey, "rsa2", nil), false},
+		{"kid of another key", sign(jwt.SigningMethodRS256, rsaKey, "ec1", nil), false},
+		{"wrong key", sign(jwt.SigningMethodRS256, otherKey, "rsa1", nil), false},
+		{"HMAC without secret", sign(jwt.SigningMethodHS256, []byte("guess"), "", nil), false},
+	}
+	for _, c := range cases {
+		if _, err := verifyToken(c.token); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok=%v got: %v", c.desc, c.ok, err)
+		}
+	}
+	// Requests are authorized with public keys alone
+	req, _ := http.NewRequest("GET", endpoint, nil)
+	if _, err := authenticate(req); err == nil {
+		t.Fatal("expected auth to be required with public keys configured")
+	}
+	// Issuer and audience
+	*serverJWTIssuer, *serverJWTAudience = "https://auth.example.com", "blobstore"
+	claims := func(iss string, aud interface{}) map[string]interface{} {
+		return map[string]interface{}{"iss": iss, "aud": aud}
+	}
+	cases = []struct {
+		desc  string
+		token string
+		ok    bool
+	}{
+		{"iss and aud", sign(jwt.SigningMethodRS256, rsaKey, "rsa1", claims("https://auth.example.com", "blobstore")), true},
+		{"aud array", sign(jwt.SigningMethodRS256, rsaKey, "rsa1", claims("https://auth.example.com", []string{"other", "blobstore"})), true},
+		{"wrong iss", sign(jwt.SigningMethodRS256, rsaKey, "rsa1", claims("https://evil.example.com", "blobstore")), false},
+		{"wrong aud", sign(jwt.SigningMethodRS256, rsaKey, "rsa1", claims("https://auth.example.com", "other")), false},
+		{"no iss or aud", sign(jwt.SigningMethodRS256, rsaKey, "rsa1", nil), false},
+	}
+	for _, c := range cases {
+		if _, err := verifyToken(c.token); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok=%v got: %v", c.desc, c.ok, err)
+		}
+	}
+	// Rotating the key file replaces the keys
+	*serverJWTIssuer, *serverJWTAudience = "", ""
+	der, _ = x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	ioutil.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": "rsa2"}, Bytes: der}), 0644)
+	rotated, err := loadPublicKeys(pemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPublicKeys(rotated)
+	if _, err := verifyToken(sign(jwt.SigningMethodRS256, rsaKey, "rsa1", nil)); err == nil {
+		t.Error("expected token signed with the retired key to be rejected")
+	}
+	if _, err := verifyToken(sign(jwt.SigningMethodRS256, otherKey, "rsa2", nil)); err != nil {
+		t.Errorf("expected token signed with the new key to verify got: %v", err)
+	}
+}
+
+func TestTokenCommand(t *testing.T) {
+	withMemoryStore(t)
+	defer func(key string, scopes, types []string, maxSize int64, id, sub string) {
+		*secretKey, *tokenScopes, *tokenTypes, *tokenMaxSize, *tokenBlob, *tokenSubject = key, scopes, types, maxSize, id, sub
+	}(*secretKey, *tokenScopes, *tokenTypes, *tokenMaxSize, *tokenBlob, *tokenSubject)
+	defer func(expiry time.Duration) { *tokenExpiry = expiry }(*tokenExpiry)
+	*secretKey, *tokenExpiry = "", time.Hour
+	if err := tokenCommand(ioutil.Discard); err == nil {
+		t.Fatal("expected error minting a token without a secret")
+	}
+	*secretKey = "test-secret"
+	id := blob.New().ID
+	*tokenScopes = []string{scopeRead, scopeWrite}
+	*tokenTypes = []string{"text/", "application/pdf"}
+	*tokenMaxSize = 1000
+	*tokenBlob = id.String()
+	*tokenSubject = "alice"
+	out := new(bytes.Buffer)
+	if err := tokenCommand(out); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := verifyToken(strings.TrimSpace(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseClaims(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.hasScope(scopeWrite) || c.hasScope(scopeDelete) || c.MaxSize != 1000 || c.Subject != "alice" || !c.allowsBlob(id) || c.allowsBlob(blob.New().ID) {
+		t.Fatalf("unexpected claims: %+v", c)
+	}
+	if exp, _ := raw["exp"].(float64); time.Unix(int64(exp), 0).Sub(time.Now()) < 59*time.Minute {
+		t.Fatalf("expected token to expire in an hour got: %v", raw["exp"])
+	}
+	// Uploads are restricted to the content types of the token
+	*tokenBlob = ""
+	out.Reset()
+	if err := tokenCommand(out); err != nil {
+		t.Fatal(err)
+	}
+	auth := "Bearer " + strings.TrimSpace(out.String())
+	png := "\x89PNG\r\n\x1a\n"
+	for _, c := range []struct {
+		ct   string
+		data string
+		code int
+	}{
+		{"text/plain; charset=utf-8", "data", 200},
+		{"application/pdf", "%PDF-1.4", 200},
+		{"image/png", png, http.StatusForbidden},
+		// The sniffed type is checked, not the claimed one
+		{"text/plain", png, http.StatusForbidden},
+	} {
+		ct, code := c.ct, c.code
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="file"`)
+		h.Set("Content-Type", ct)
+		part, _ := w.CreatePart(h)
+		part.Write([]byte(c.data))
+		w.Close()
+		req, _ := http.NewRequest("POST", endpoint, body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Fatalf("%d expected uploading %s got: %d", code, ct, res.StatusCode)
+		}
+	}
+	// Sniffing replaces a claim of application/pdfx for PDF data with
+	// application/pdf, so check it is not allowed as a prefix directly
+	if !allowsType(c.Types, "application/pdf") || allowsType(c.Types, "application/pdfx") {
+		t.Fatalf("expected application/pdf to only allow that exact type got: %v", c.Types)
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	withMemoryStore(t)
+	defer func(key, mode, addr string) { *secretKey, *serverReadAuth, *clientAddr = key, mode, addr }(*secretKey, *serverReadAuth, *clientAddr)
+	*secretKey, *serverReadAuth, *clientAddr = "test-secret", readAuthToken, endpoint
+	b := blob.New()
+	b.Name = "private.txt"
+	if err := b.WriteFrom(strings.NewReader("private data")); err != nil {
+		t.Fatal(err)
+	}
+	get := func(u string) int {
+		res, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// Download URLs
+	out := new(bytes.Buffer)
+	*signID = b.ID.String()
+	defer func() { *signID = "" }()
+	if err := signCommand(out); err != nil {
+		t.Fatal(err)
+	}
+	signed := strings.TrimSpace(out.String())
+	if code := get(signed); code != 200 {
+		t.Fatalf("200 expected downloading with signed URL got: %d", code)
+	}
+	if code := get(endpoint + b.ID.String()); code != http.StatusUnauthorized {
+		t.Fatalf("401 expected downloading without signature got: %d", code)
+	}
+	if code := get(strings.Replace(signed, "sig=", "sig=x", 1)); code != http.StatusForbidden {
+		t.Fatalf("403 expected with tampered signature got: %d", code)
+	}
+	other := blob.New()
+	other.WriteFrom(strings.NewReader("other data"))
+	if code := get(strings.Replace(signed, b.ID.String(), other.ID.String(), 1)); code != http.StatusForbidden {
+		t.Fatalf("403 expected using signature for another blob got: %d", code)
+	}
+	expired, _ := signURL("GET", "/"+b.ID.String(), url.Values{}, time.Now().Add(-time.Second))
+	if code := get(strings.TrimRight(endpoint, "/") + expired); code != http.StatusForbidden {
+		t.Fatalf("403 expected with expired signed URL got: %d", code)
+	}
+	// Upload URLs allow one upload within their constraints
+	c := newClient()
+	post := func(u, ct string, data []byte) int {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="file"`)
+		h.Set("Content-Type", ct)
+		part, _ := w.CreatePart(h)
+		part.Write(data)
+		w.Close()
+		res, err := http.Post(u, w.FormDataContentType(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	text := []byte("eleven char")
+	policy := client.UploadPolicy{MaxSize: 10, ContentTypes: []string{"text/"}}
+	signUpload := func() string {
+		s, err := c.SignUpload(context.Background(), policy, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.URL
+	}
+	u := signUpload()
+	if code := post(u, "text/plain", text[:10]); code != 200 {
+		t.Fatalf("200 expected uploading with signed URL got: %d", code)
+	}
+	if code := post(u, "text/plain", text[:10]); code != http.StatusForbidden {
+		t.Fatalf("403 expected reusing signed upload URL got: %d", code)
+	}
+	// Rejected uploads do not use up the URL
+	u = signUpload()
+	if code := post(u, "text/plain", text); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("413 expected over signed max size got: %d", code)
+	}
+	if code := post(u, "image/png", []byte("\x89PNG\r\n\x1a\n\x00\x00")); code != http.StatusForbidden {
+		t.Fatalf("403 expected for content type not allowed by signed URL got: %d", code)
+	}
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	for _, name := range []string{"one.txt", "two.txt"} {
+		part, _ := w.CreateFormFile("file", name)
+		part.Write(text[:10])
+	}
+	w.Close()
+	res, err := http.Post(u, w.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("403 expected uploading two files with signed URL got: %d", res.StatusCode)
+	}
+	n := 0
+	blob.DefaultStore.Backend().(blob.Walker).Walk(func(uuid.UUID) error { n++; return nil })
+	if n != 3 {
+		t.Fatalf("expected the two test blobs and one signed upload stored got: %d blobs", n)
+	}
+	if code := post(u, "text/plain", text[:10]); code != 200 {
+		t.Fatalf("200 expected uploading with signed URL after rejected uploads got: %d", code)
+	}
+	// URLs never grant more than the token
+	limited, err := jwtEncode(*secretKey, map[string]interface{}{"scope": "write", "max_size": 5}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Tokens = client.StaticToken(limited)
+	if _, err := c.SignUpload(context.Background(), policy, time.Minute); !errors.Is(err, client.ErrForbidden) {
+		t.Fatalf("expected forbidden signing upload larger than token allows got: %v", err)
+	}
+	if _, err := c.SignDownload(context.Background(), b.ID, time.Minute); !errors.Is(err, client.ErrForbidden) {
+		t.Fatalf("expected forbidden signing download without read scope got: %v", err)
+	}
+}
+
+func TestOwnershipACL(t *testing.T) {
+	withMemoryStore(t)
+	blob.DefaultStore.SetIndex(blob.NewIndex())
+	defer func(key, mode, addr string) { *secretKey, *serverReadAuth, *clientAddr = key, mode, addr }(*secretKey, *serverReadAuth, *clientAddr)
+	*secretKey, *serverReadAuth, *clientAddr = "test-secret", readAuthPublic, endpoint
+	as := func(claims map[string]interface{}) *client.Client {
+		s, err := jwtEncode(*secretKey, claims, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := client.New(endpoint)
+		c.Tokens = client.StaticToken(s)
+		return c
+	}
+	ctx := context.Background()
+	alice := as(map[string]interface{}{"sub": "alice"})
+	bob := as(map[string]interface{}{"sub": "bob"})
+	staff := as(map[string]interface{}{"sub": "carol", "groups": []string{"staff"}})
+	admin := as(map[string]interface{}{"sub": "root", "scope": "admin"})
+	anon := client.New(endpoint)
+	b, err := alice.Put(ctx, "owned.txt", strings.NewReader("alice's data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Owner != "alice" {
+		t.Fatalf("expected owner to be recorded from sub got: %q", b.Owner)
+	}
+	read := func(c *client.Client) error {
+		data, err := c.Get(ctx, b.ID)
+		if err == nil {
+			data.Close()
+		}
+		return err
+	}
+	// Public blobs are readable by anyone
+	if err := read(anon); err != nil {
+		t.Fatalf("expected public blob to be readable got: %v", err)
+	}
+	// Only the owner or an admin can change access
+	if _, err := bob.SetAccess(ctx, b.ID, blob.Private, nil); !errors.Is(err, client.ErrForbidden) {
+		t.Fatalf("expected forbidden changing access as another user got: %v", err)
+	}
+	// Blobs without an owner cannot be kept private
+	ownerless := blob.New()
+	if err := ownerless.WriteFrom(strings.NewReader("ownerless data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.SetAccess(ctx, ownerless.ID, blob.Private, nil); !errors.Is(err, client.ErrForbidden) {
+		t.Fatalf("expected forbidden making a blob without an owner private got: %v", err)
+	}
+	if err := ownerless.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.SetAccess(ctx, b.ID, "secret", nil); !errors.Is(err, client.ErrBadRequest) {
+		t.Fatalf("expected bad request for invalid visibility got: %v", err)
+	}
+	updated, err := alice.SetAccess(ctx, b.ID, blob.Private, &blob.ACL{Read: []string{"group:staff"}, Delete: []string{"bob"}})
+	if err != nil || !updated.Private() {
+		t.Fatalf("expected owner to make blob private got: %+v %v", updated, err)
+	}
+	// Private blobs are only readable by the owner, admins and the ACL
+	for name, c := range map[string]*client.Client{"owner": alice, "group": staff, "admin": admin} {
+		if err := read(c); err != nil {
+			t.Errorf("expected %s to read private blob got: %v", name, err)
+		}
+	}
+	if err := read(bob); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected forbidden reading private blob without ACL entry got: %v", err)
+	}
+	if err := read(anon); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("expected unauthorized reading private blob without token got: %v", err)
+	}
+	// Listings leave out private blobs the token is not granted
+	for c, n := range map[*client.Client]int{staff: 1, bob: 0} {
+		blobs, _, err := c.List(ctx, blob.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blobs) != n {
+			t.Errorf("expected %d blobs listed got: %d", n, len(blobs))
+		}
+	}
+	// Deletes are limited to the owner, admins and the ACL
+	if err := staff.Delete(ctx, b.ID); !errors.Is(err, client.ErrForbidden) {
+		t.Fatalf("expected forbidden deleting without ACL entry got: %v", err)
+	}
+	if err := bob.Delete(ctx, b.ID); err != nil {
+		t.Fatalf("expected delete ACL entry to delete got: %v", err)
+	}
+}
+
+func TestUploadDetectsMeta(t *testing.T) {
+	withMemoryStore(t)
+	b, err := client.New(endpoint).Put(context.Background(), "notes.txt", strings.NewReader("one\ntwo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Meta["lines"] != "2" || b.Meta["encoding"] != "us-ascii" {
+		t.Fatalf("expected detected text meta got: %v", b.Meta)
+	}
+}
+
+func TestContentSniffing(t *testing.T) {
+	withMemoryStore(t)
+	defer func(reject bool, allow []string) { *serverRejectMismatch, *serverAllowTypes = reject, allow }(*serverRejectMismatch, *serverAllowTypes)
+	exe := make([]byte, 128)
+	copy(exe, "MZ")
+	exe[0x3c] = 64
+	copy(exe[64:], "PE\x00\x00")
+	upload := func(name, ct string, data []byte) (*blob.Blob, int) {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, name))
+		if ct != "" {
+			h.Set("Content-Type", ct)
+		}
+		part, _ := w.CreatePart(h)
+		part.Write(data)
+		w.Close()
+		res, err := http.Post(endpoint, w.FormDataContentType(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var blobs []*blob.Blob
+		json.NewDecoder(res.Body).Decode(&blobs)
+		if len(blobs) != 1 {
+			return nil, res.StatusCode
+		}
+		return blobs[0], res.StatusCode
+	}
+	// Renamed executables are not served as images
+	b, code := upload("cat.jpg", "image/jpeg", exe)
+	if code != 200 {
+		t.Fatalf("200 expected got: %d", code)
+	}
+	if b.ContentType != "application/vnd.microsoft.portable-executable" || b.Meta["claimed_type"] != "image/jpeg" || b.Meta["detected_type"] != b.ContentType {
+		t.Fatalf("expected detected type to be stored got: %s %v", b.ContentType, b.Meta)
+	}
+	// More specific claims are kept
+	b, _ = upload("data.csv", "", []byte("a,b\n1,2\n"))
+	if b.ContentType != "text/csv; charset=utf-8" || b.Meta["detected_type"] != "text/plain; charset=utf-8" {
+		t.Fatalf("expected claimed csv type to be kept got: %s %v", b.ContentType, b.Meta)
+	}
+	// Text is never served as HTML unless it sniffs as HTML
+	b, _ = upload("page.html", "text/html", []byte("hello <script>alert(1)</script>"))
+	if b.ContentType != "text/plain; charset=utf-8" {
+		t.Fatalf("expected text claimed as html to be stored as text got: %s", b.ContentType)
+	}
+	res, err := http.Get(endpoint + b.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ct, opts := res.Header.Get("Content-Type"), res.Header.Get("X-Content-Type-Options"); ct != b.ContentType || opts != "nosniff" {
+		t.Fatalf("expected text served with nosniff got: %s %q", ct, opts)
+	}
+	// Nor do conflicting claims make data scriptable
+	for _, data := range []string{"<svg onload=alert(1)>", "<html><script>alert(1)</script>"} {
+		b, _ = upload("cat.png", "image/png", []byte(data))
+		if b.ContentType != "text/plain; charset=utf-8" {
+			t.Fatalf("expected %q claimed as png to be stored as text got: %s", data, b.ContentType)
+		}
+	}
+	*serverRejectMismatch = true
+	if _, code := upload("cat.jpg", "image/jpeg", exe); code != http.StatusUnsupportedMediaType {
+		t.Fatalf("415 expected for mismatched content got: %d", code)
+	}
+	*serverRejectMismatch = false
+	*serverAllowTypes = []string{"image/", "text/plain"}
+	if _, code := upload("tool.exe", "", exe); code != http.StatusUnsupportedMediaType {
+		t.Fatalf("415 expected for type outside allow-list got: %d", code)
+	}
+	if _, code := upload("notes.txt", "", []byte("notes")); code != 200 {
+		t.Fatalf("200 expected for allowed type got: %d", code)
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	withMemoryStore(t)
+	defer func(max int, sizes []int) { *serverThumbMax, *serverThumbSizes = max, sizes }(*serverThumbMax, *serverThumbSizes)
+	*serverThumbMax, *serverThumbSizes = 512, []int{32, 64, 128}
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c := client.New(endpoint)
+	photo, err := c.Put(context.Background(), "test.jpg", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := c.Put(context.Background(), "notes.txt", strings.NewReader("notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(method, path, inm string) *http.Response {
+		req, _ := http.NewRequest(method, endpoint+path, nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := get("GET", photo.ID.String()+"?w=64&fmt=png", "")
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("expected png thumbnail got: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	img, _, err := image.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 64 {
+		t.Fatalf("expected 64 pixel wide thumbnail got: %v", img.Bounds())
+	}
+	tag := res.Header.Get("ETag")
+	if tag != `"`+photo.SHA256+`-w64-h0-contain.png"` || res.Header.Get("Last-Modified") == "" {
+		t.Fatalf("expected thumbnail etag and last-modified got: %v", res.Header)
+	}
+	if res := get("GET", photo.ID.String()+"?w=64&fmt=png", tag); res.StatusCode != http.StatusNotModified {
+		t.Fatalf("304 expected got: %d", res.StatusCode)
+	}
+	if res := get("HEAD", photo.ID.String()+"?w=32&h=32&fit=cover", ""); res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("expected jpeg thumbnail headers got: %d %v", res.StatusCode, res.Header)
+	}
+	cases := []struct {
+		path string
+		code int
+	}{
+		{photo.ID.String() + "?w=128&h=64&fit=fill", 200},
+		{photo.ID.String() + "?w=100", http.StatusBadRequest},
+		{photo.ID.String() + "?w=1024", http.StatusBadRequest},
+		{photo.ID.String() + "?w=-64", http.StatusBadRequest},
+		{photo.ID.String() + "?w=64&fit=zoom", http.StatusBadRequest},
+		{photo.ID.String() + "?fmt=png", http.StatusBadRequest},
+		{notes.ID.String() + "?w=64", http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		if res := get("GET", c.path, ""); res.StatusCode != c.code {
+			t.Errorf("%s: %d expected got: %d", c.path, c.code, res.StatusCode)
+		}
+	}
+	// Only a few sizes are allowed by default
+	*serverThumbSizes = nil
+	if res := get("GET", photo.ID.String()+"?w=256", ""); res.StatusCode != 200 {
+		t.Fatalf("200 expected for a default size got: %d", res.StatusCode)
+	}
+	if res := get("GET", photo.ID.String()+"?w=255", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("400 expected for a size not allowed by default got: %d", res.StatusCode)
+	}
+	*serverThumbMax = 0
+	if res := get("GET", photo.ID.String()+"?w=64", ""); res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("501 expected when resizing is disabled got: %d", res.StatusCode)
+	}
+}
+
+func TestStripEXIF(t *testing.T) {
+	withMemoryStore(t)
+	defer func(key, mode string, strip bool) {
+		*secretKey, *serverReadAuth, *serverStripEXIF = key, mode, strip
+	}(*secretKey, *serverReadAuth, *serverStripEXIF)
+	*secretKey, *serverReadAuth, *serverStripEXIF = "test-secret", readAuthPublic, true
+	photo, err := ioutil.ReadFile("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EXIF with the camera make and a GPS IFD
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x02\x00" +
+		"\x0f\x01\x02\x00\x04\x00\x00\x00Cam\x00" +
+		"\x25\x88\x04\x00\x01\x00\x00\x00\x26\x00\x00\x00" +
+		"\x00\x00\x00\x00GPS-SECRET")
+	app1 := append([]byte{0xff, 0xe1, 0, byte(8 + len(tiff))}, "Exif\x00\x00"...)
+	tagged := append(append(append([]byte{}, photo[:2]...), append(app1, tiff...)...), photo[2:]...)
+	token := func(scope, sub string) string {
+		s, err := jwtEncode(*secretKey, map[string]interface{}{"scope": scope, "sub": sub}, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + s
+	}
+	upload := func(auth string, header http.Header) (*blob.Blob, int) {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		part, _ := w.CreateFormFile("file", "photo.jpg")
+		part.Write(tagged)
+		w.Close()
+		req, _ := http.NewRequest("POST", endpoint, body)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var blobs []*blob.Blob
+		json.NewDecoder(res.Body).Decode(&blobs)
+		if len(blobs) != 1 {
+			return nil, res.StatusCode
+		}
+		return blobs[0], res.StatusCode
+	}
+	data := func(id uuid.UUID) []byte {
+		b, err := blob.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := b.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		d, _ := ioutil.ReadAll(f)
+		return d
+	}
+	writer := token("write delete", "alice")
+	b, code := upload(writer, http.Header{"X-Exif-Meta": {"true"}})
+	if code != 200 {
+		t.Fatalf("200 expected got: %d", code)
+	}
+	if !bytes.Equal(data(b.ID), photo) || b.ContentType != "image/jpeg" {
+		t.Fatal("expected EXIF to be stripped")
+	}
+	if b.Meta["exif_make"] != "Cam" || b.Meta["original"] != "" {
+		t.Fatalf("expected exif meta without an original got: %v", b.Meta)
+	}
+	if b, _ = upload(writer, http.Header{"X-Strip-Exif": {"false"}}); !bytes.Equal(data(b.ID), tagged) || b.Meta["exif_make"] != "" {
+		t.Fatal("expected EXIF to be kept when stripping is turned off")
+	}
+	// JPEGs too large to strip in memory are refused rather than stored with their metadata
+	defer func(size int64) { blob.MaxStripSize = size }(blob.MaxStripSize)
+	blob.MaxStripSize = int64(len(tagged) - 1)
+	if _, code := upload(writer, nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("413 expected stripping a jpeg over the limit got: %d", code)
+	}
+	blob.MaxStripSize = int64(len(tagged))
+	// Keeping the original needs the original scope
+	if _, code := upload(writer, http.Header{"X-Keep-Original": {"true"}}); code != http.StatusForbidden {
+		t.Fatalf("403 expected without original scope got: %d", code)
+	}
+	// and a subject to own the original
+	if _, code := upload(token("write original", ""), http.Header{"X-Keep-Original": {"true"}}); code != http.StatusForbidden {
+		t.Fatalf("403 expected keeping original without a subject got: %d", code)
+	}
+	b, code = upload(token("write delete original", "alice"), http.Header{"X-Keep-Original": {"true"}})
+	if code != 200 {
+		t.Fatalf("200 expected got: %d", code)
+	}
+	id, err := uuid.ParseUUID(b.Meta["original"])
+	if err != nil {
+		t.Fatalf("expected original in meta got: %v", b.Meta)
+	}
+	original, err := blob.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !original.Private() || original.Owner != "alice" || !bytes.Equal(data(id), tagged) {
+		t.Fatalf("expected private original owned by the uploader got: %+v", original)
+	}
+	// Only the owner can read the original, even though reads are public
+	for auth, code := range map[string]int{"": http.StatusUnauthorized, token("read", "bob"): http.StatusForbidden, token("read", "alice"): 200} {
+		req, _ := http.NewRequest("GET", endpoint+id.String(), nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Fatalf("%d expected reading original with %q got: %d", code, auth, res.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest("DELETE", endpoint+b.ID.String(), nil)
+	req.Header.Set("Authorization", writer)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err := blob.Get(id); err != blob.ErrNotFound {
+		t.Fatalf("expected original to be deleted with the blob got: %v", err)
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	store := withMemoryStore(t)
+	store.SetIndex(blob.NewIndex())
+	defer func(p map[string]blob.Thumbnail) { presets = p }(presets)
+	var err error
+	presets, err = parsePresets(map[string]string{"avatar": "w=32,h=32,fit=cover", "preview": "w=64,fmt=png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, defs := range []map[string]string{{"avatar": "w=0"}, {"avatar": "w=32,zoom=2"}, {"avatar": "w=32,fit=zoom"}, {"info": "w=32"}, {"Big": "w=32"}} {
+		if _, err := parsePresets(defs); err == nil {
+			t.Errorf("expected %v to be rejected", defs)
+		}
+	}
+	photo, err := ioutil.ReadFile("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.New(endpoint)
+	b, err := c.Put(context.Background(), "test.jpg", bytes.NewReader(photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := c.Put(context.Background(), "notes.txt", strings.NewReader("notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lazily rendered on first request
+	res, err := http.Get(endpoint + b.ID.String() + "/avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Content-Type") != "image/jpeg" || img.Bounds().Dx() != 32 || img.Bounds().Dy() != 32 {
+		t.Fatalf("expected 32x32 jpeg got: %s %v", res.Header.Get("Content-Type"), img.Bounds())
+	}
+	info, err := c.Info(context.Background(), b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := info.Renditions["avatar"]; r.Preset != "w32-h32-cover.jpeg" || r.ContentType != "image/jpeg" || len(info.Renditions) != 1 {
+		t.Fatalf("expected avatar rendition in metadata got: %+v", info.Renditions)
+	}
+	for path, code := range map[string]int{
+		b.ID.String() + "/missing":           http.StatusNotFound,
+		notes.ID.String() + "/avatar":        http.StatusUnsupportedMediaType,
+		b.ID.String() + "/info":              200,
+		uuid.TimeUUID().String() + "/avatar": http.StatusNotFound,
+	} {
+		res, err := http.Get(endpoint + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("%s: %d expected got: %d", path, code, res.StatusCode)
+		}
+	}
+
+	// Only images that can be resized are queued for missing renditions
+	svg := blob.New()
+	svg.ContentType = "image/svg+xml"
+	if err := svg.WriteFrom(strings.NewReader("<svg/>")); err != nil {
+		t.Fatal(err)
+	}
+	renderQueue = make(chan uuid.UUID, 10)
+	queueStale(store, nil)
+	if len(renderQueue) != 1 || <-renderQueue != b.ID {
+		t.Fatal("expected only the image missing a rendition to be queued")
+	}
+
+	// Eagerly rendered after upload, and again when a preset changes
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	renderQueue = startRenderers(2, stop, &wg)
+	defer func() {
+		close(stop)
+		wg.Wait()
+		renderQueue = nil
+	}()
+	waitFor := func(id uuid.UUID, preset, name string) {
+		for i := 0; i < 100; i++ {
+			if b, err := blob.Get(id); err == nil && b.Renditions[preset].Preset == name {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("expected %s rendition %s of blob %s", preset, name, id)
+	}
+	eager, err := c.Put(context.Background(), "test.jpg", bytes.NewReader(photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(eager.ID, "avatar", "w32-h32-cover.jpeg")
+	waitFor(eager.ID, "preview", "w64-h0-contain.png")
+	presets = map[string]blob.Thumbnail{"avatar": {Width: 48, Height: 32, Fit: blob.FitCover}, "preview": presets["preview"]}
+	queueStale(store, stop)
+	waitFor(b.ID, "avatar", "w48-h32-cover.jpeg")
+	waitFor(eager.ID, "avatar", "w48-h32-cover.jpeg")
+	waitFor(b.ID, "preview", "w64-h0-contain.png")
+}
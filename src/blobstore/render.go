@@ -0,0 +1,183 @@
+package main
+
+import (
+	"blob"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"uuid"
+)
+
+// renditionPathMatcher matches the path of the rendition of a blob made from
+// a named preset
+var renditionPathMatcher = regexp.MustCompile(`^/([a-zA-Z0-9\-]+)/([a-z0-9][a-z0-9_\-]*)$`)
+
+// presets are the named rendition presets from --preset by name
+var presets = map[string]blob.Thumbnail{}
+
+// parsePresets parses the --preset definitions, which are comma separated
+// w, h, fit and fmt parameters as for resizing downloads, such as
+// avatar=w=128,h=128,fit=cover
+func parsePresets(defs map[string]string) (map[string]blob.Thumbnail, error) {
+	parsed := map[string]blob.Thumbnail{}
+	for name, def := range defs {
+		if name == "info" || !renditionPathMatcher.MatchString("/id/"+name) {
+			return nil, fmt.Errorf("invalid preset name %q", name)
+		}
+		t, err := parsePreset(def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset %s: %v", name, err)
+		}
+		parsed[name] = t
+	}
+	return parsed, nil
+}
+
+// parsePreset parses the definition of a preset
+func parsePreset(def string) (blob.Thumbnail, error) {
+	t := blob.Thumbnail{}
+	q, err := url.ParseQuery(strings.Replace(def, ",", "&", -1))
+	if err != nil {
+		return t, err
+	}
+	for k := range q {
+		switch k {
+		case "w":
+			t.Width, err = strconv.Atoi(q.Get(k))
+		case "h":
+			t.Height, err = strconv.Atoi(q.Get(k))
+		case "fit":
+			t.Fit = q.Get(k)
+		case "fmt":
+			t.Format = q.Get(k)
+		default:
+			err = fmt.Errorf("unknown parameter %q", k)
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+	// Check the definition against any image, leaving the defaults that
+	// depend on the image unset
+	check := t
+	return t, check.SetDefaults("image/png")
+}
+
+// renderQueue holds the IDs of blobs to generate the renditions of in the
+// background, nil if renditions are only generated on first request
+var renderQueue chan uuid.UUID
+
+// startRenderers starts n workers generating the renditions of the blobs
+// sent to the returned queue until stop is closed. The workers are added to
+// wg.
+func startRenderers(n int, stop <-chan struct{}, wg *sync.WaitGroup) chan uuid.UUID {
+	queue := make(chan uuid.UUID, 1000)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case id := <-queue:
+					renderAll(id)
+				}
+			}
+		}()
+	}
+	return queue
+}
+
+// queueRender asks for the renditions of b to be generated in the
+// background. If the queue is full they are generated on first request.
+func queueRender(b *blob.Blob) {
+	if renderQueue == nil || len(presets) == 0 || !strings.HasPrefix(b.ContentType, "image/") {
+		return
+	}
+	select {
+	case renderQueue <- b.ID:
+	default:
+		fmt.Println("render queue full, skipping renditions of blob", b.ID)
+	}
+}
+
+// renderAll generates the renditions of the blob with id that are missing
+// or were made from an older definition of their preset
+func renderAll(id uuid.UUID) {
+	b, err := blob.Get(id)
+	if err != nil {
+		return
+	}
+	for name, t := range presets {
+		if b.HasRendition(name, t) {
+			continue
+		}
+		f, err := b.Render(name, t)
+		if err == blob.ErrNotImage {
+			return
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "rendering", name, "of blob", id, "failed:", err)
+			continue
+		}
+		f.Close()
+	}
+}
+
+// queueStale queues the images in the store whose renditions are missing or
+// were made from an older definition of their preset, such as after the
+// presets were changed. It gives up when stop is closed.
+func queueStale(store *blob.Store, stop <-chan struct{}) {
+	q := blob.Query{ContentType: "image/", Limit: blob.MaxQueryLimit}
+	for {
+		blobs, next, err := store.List(q)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "finding stale renditions:", err)
+			return
+		}
+		for _, b := range blobs {
+			for name, t := range presets {
+				if b.HasRendition(name, t) {
+					continue
+				}
+				// Images that cannot be resized, such as SVGs, never
+				// have renditions
+				if t.SetDefaults(b.ContentType) != nil {
+					break
+				}
+				select {
+				case renderQueue <- b.ID:
+				case <-stop:
+					return
+				}
+				break
+			}
+		}
+		if !next.Valid() {
+			return
+		}
+		q.After = next
+	}
+}
+
+// renditionHandler responds with the rendition of an image blob made from
+// the preset named in the path, generating it on first request
+func renditionHandler(w http.ResponseWriter, r *http.Request) error {
+	b, err := readableBlob(r, renditionPathMatcher)
+	if err != nil {
+		return err
+	}
+	name := renditionPathMatcher.FindStringSubmatch(r.URL.Path)[2]
+	t, ok := presets[name]
+	if !ok {
+		return &statusError{http.StatusNotFound, fmt.Errorf("no preset named %s", name)}
+	}
+	return serveThumbnail(w, r, b, &t, func() (blob.File, error) {
+		return b.Render(name, t)
+	})
+}
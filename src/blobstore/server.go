@@ -2,15 +2,20 @@ package main
 
 import (
 	"blob"
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"time"
 	"uuid"
 )
 
@@ -19,21 +24,105 @@ const ApplicationOctetStream = "application/octet-stream"
 // URL for blobs
 var blobPathMatcher = regexp.MustCompile(`^/([a-zA-Z0-9\-]+)$`)
 
-// Fetch, decode and verify authorization header.
-func authenticate(r *http.Request) (map[string]interface{}, error) {
-	if *secretKey == "" {
-		return map[string]interface{}{}, nil // DISABLE AUTH
+// URL for blob metadata, either /{uuid}.json or /{uuid}/info
+var infoPathMatcher = regexp.MustCompile(`^/([a-zA-Z0-9\-]+)(?:\.json|/info)$`)
+
+// scrubber re-verifies blob checksums in the background, nil if disabled
+var scrubber *blob.Scrubber
+
+// statusError is an error that should be reported with a specific HTTP status
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// errorStatus returns the HTTP status code to report err with
+func errorStatus(err error) int {
+	if e, ok := err.(*statusError); ok {
+		return e.code
+	}
+	if err == blob.ErrNotFound {
+		return http.StatusNotFound
 	}
-	token := r.Header.Get("Authorization")
-	return jwtDecode(*secretKey, token)
+	if err == blob.ErrExpired {
+		return http.StatusGone
+	}
+	if err == blob.ErrCorrupt {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// writeError logs err and responds with it
+func writeError(w http.ResponseWriter, err error) {
+	fmt.Fprintln(os.Stderr, err)
+	status := errorStatus(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="blobstore"`)
+	}
+	http.Error(w, err.Error(), status)
 }
 
 // UploadHandler accepts multipart form uploads of a blob and stores it on S3
 func BlobHandler(w http.ResponseWriter, r *http.Request) {
 	if err := blobHandler(w, r); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		http.Error(w, err.Error(), 400)
+		writeError(w, err)
+	}
+}
+
+// DedupHandler reports the space saved by deduplication
+func DedupHandler(w http.ResponseWriter, r *http.Request) {
+	if err := dedupHandler(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+func dedupHandler(w http.ResponseWriter, r *http.Request) error {
+	// Auth
+	if _, err := authorize(r, scopeAdmin, uuid.UUID{}); err != nil {
+		return err
+	}
+	disk, ok := blob.DefaultStore.Backend().(*blob.DiskBackend)
+	if !ok {
+		return &statusError{http.StatusNotFound, errors.New("deduplication is not available for this backend")}
+	}
+	stats, err := disk.DedupStats()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(stats); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ScrubHandler reports the progress of the scrubber and corrupt blobs found
+func ScrubHandler(w http.ResponseWriter, r *http.Request) {
+	if err := scrubHandler(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+func scrubHandler(w http.ResponseWriter, r *http.Request) error {
+	// Auth
+	if _, err := authorize(r, scopeAdmin, uuid.UUID{}); err != nil {
+		return err
+	}
+	if scrubber == nil {
+		return &statusError{http.StatusNotFound, errors.New("scrubbing is disabled")}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(scrubber.Stats()); err != nil {
+		return err
+	}
+	return nil
 }
 
 func blobHandler(w http.ResponseWriter, r *http.Request) error {
@@ -42,29 +131,131 @@ func blobHandler(w http.ResponseWriter, r *http.Request) error {
 	if origin := h.Get("Origin"); origin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
-	h.Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	h.Set("Access-Control-Allow-Methods", "POST, GET, HEAD, OPTIONS, PUT, PATCH, DELETE")
 	h.Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	// Browsers must not second guess the content type of blobs
+	h.Set("X-Content-Type-Options", "nosniff")
 	// Router
 	switch r.Method {
 	case "POST":
 		return uploadHandler(w, r)
+	case "DELETE":
+		return deleteHandler(w, r)
+	case "PATCH":
+		return accessHandler(w, r)
+	case "HEAD":
+		return headHandler(w, r)
 	case "OPTIONS":
 		return nil
 	default:
+		if r.URL.Path == "/" {
+			return listHandler(w, r)
+		}
+		if infoPathMatcher.MatchString(r.URL.Path) {
+			return infoHandler(w, r)
+		}
+		if renditionPathMatcher.MatchString(r.URL.Path) {
+			return renditionHandler(w, r)
+		}
 		return downloadHandler(w, r)
 	}
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) error {
-	match := blobPathMatcher.FindStringSubmatch(r.URL.Path)
-	if len(match) != 2 {
-		return errors.New("bad request: " + r.URL.String())
+func infoHandler(w http.ResponseWriter, r *http.Request) error {
+	b, err := readableBlob(r, infoPathMatcher)
+	if err != nil {
+		return err
+	}
+	if b.Expired() {
+		return blob.ErrExpired
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// listResponse is the JSON response of the listing endpoint. Next is the
+// cursor to pass as the after parameter to fetch the next page.
+type listResponse struct {
+	Blobs []*blob.Blob `json:"blobs"`
+	Next  string       `json:"next,omitempty"`
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) error {
+	// Auth
+	c, err := authorize(r, scopeRead, uuid.UUID{})
+	if err != nil {
+		return err
 	}
-	id, err := uuid.ParseUUID(match[1])
+	q, err := blob.ParseQuery(r.URL.Query())
 	if err != nil {
 		return err
 	}
-	blob, err := blob.Get(id)
+	blobs, next, err := blob.DefaultStore.List(q)
+	if err == blob.ErrNoIndex {
+		return &statusError{http.StatusNotImplemented, err}
+	} else if err != nil {
+		return err
+	}
+	// Leave out private blobs the token is not granted
+	res := listResponse{Blobs: []*blob.Blob{}}
+	for _, b := range blobs {
+		if !b.Private() || c.granted(b, readers(b)) {
+			res.Blobs = append(res.Blobs, b)
+		}
+	}
+	if next.Valid() {
+		res.Next = next.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(res); err != nil {
+		return err
+	}
+	return nil
+}
+
+// idFromPath returns the ID of the blob addressed by the request path
+func idFromPath(r *http.Request, matcher *regexp.Regexp) (uuid.UUID, error) {
+	match := matcher.FindStringSubmatch(r.URL.Path)
+	if len(match) < 2 {
+		return uuid.UUID{}, errors.New("bad request: " + r.URL.String())
+	}
+	return uuid.ParseUUID(match[1])
+}
+
+// etag returns the strong entity tag for the blob data, which is its SHA-256.
+// Blobs stored before checksums were recorded fall back to the ID, which is
+// also strong as blob data never changes once written.
+func etag(b *blob.Blob) string {
+	if b.SHA256 != "" {
+		return `"` + b.SHA256 + `"`
+	}
+	return `"` + b.ID.String() + `"`
+}
+
+// setBlobHeaders sets the representation headers for the blob data
+func setBlobHeaders(w http.ResponseWriter, b *blob.Blob) {
+	h := w.Header()
+	if b.ContentType != "" {
+		h.Set("Content-Type", b.ContentType)
+	}
+	h.Set("ETag", etag(b))
+	h.Set("Last-Modified", b.Time().UTC().Format(http.TimeFormat))
+	if b.ExpiresAt != nil {
+		h.Set("Expires", b.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	setDigestHeaders(w, b)
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) error {
+	if wantsThumbnail(r) {
+		return thumbnailHandler(w, r)
+	}
+	blob, err := readableBlob(r, blobPathMatcher)
 	if err != nil {
 		return err
 	}
@@ -73,62 +264,400 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	defer f.Close()
-	if blob.ContentType != "" {
-		w.Header().Set("Content-Type", blob.ContentType)
-	}
+	setBlobHeaders(w, blob)
 	http.ServeContent(w, r, blob.Name, blob.Time(), f)
 	return nil
 }
 
-// Copy form file to Blob
-func upload(f *multipart.FileHeader) (b *blob.Blob, err error) {
-	// Open
-	upload, err := f.Open()
+// headHandler responds with the headers of a download using only the blob
+// metadata, without touching the blob data.
+func headHandler(w http.ResponseWriter, r *http.Request) error {
+	if wantsThumbnail(r) {
+		return thumbnailHandler(w, r)
+	}
+	if renditionPathMatcher.MatchString(r.URL.Path) && !infoPathMatcher.MatchString(r.URL.Path) {
+		return renditionHandler(w, r)
+	}
+	if infoPathMatcher.MatchString(r.URL.Path) {
+		b, err := readableBlob(r, infoPathMatcher)
+		if err != nil {
+			return err
+		}
+		if b.Expired() {
+			return blob.ErrExpired
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return nil
+	}
+	b, err := readableBlob(r, blobPathMatcher)
 	if err != nil {
-		return
+		return err
+	}
+	if b.Expired() {
+		return blob.ErrExpired
+	}
+	if b.Corrupt {
+		return blob.ErrCorrupt
+	}
+	setBlobHeaders(w, b)
+	if !checkPreconditions(w, r, etag(b)) {
+		return nil
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(b.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := idFromPath(r, blobPathMatcher)
+	if err != nil {
+		return err
+	}
+	// Auth
+	c, err := authorize(r, scopeDelete, id)
+	if err != nil {
+		return err
+	}
+	b, err := blob.Get(id)
+	if err != nil {
+		return err
+	}
+	if !c.granted(b, deleters(b)) {
+		return forbidden("token does not grant deleting blob %s", id)
+	}
+	if !checkPreconditions(w, r, etag(b)) {
+		return nil
+	}
+	if err := deleteBlob(b); err != nil {
+		return err
+	}
+	fmt.Println("deleted blob", b.ID, "for", b.Name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// accessHandler changes the visibility and ACL of a blob to those given in
+// the JSON request body. Fields left out of the body are unchanged. Only
+// the owner of the blob or an admin can change them.
+func accessHandler(w http.ResponseWriter, r *http.Request) error {
+	id, err := idFromPath(r, blobPathMatcher)
+	if err != nil {
+		return err
+	}
+	// Auth
+	c, err := authorize(r, scopeWrite, id)
+	if err != nil {
+		return err
+	}
+	b, err := blob.Get(id)
+	if err != nil {
+		return err
+	}
+	if !c.owns(b) {
+		return forbidden("only the owner can change access to blob %s", id)
+	}
+	var req struct {
+		Visibility *string   `json:"visibility"`
+		ACL        *blob.ACL `json:"acl"`
+	}
+	var fields map[string]json.RawMessage
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return err
+	}
+	visibility, acl := b.Visibility, b.ACL
+	if req.Visibility != nil {
+		if visibility, err = parseVisibility(*req.Visibility); err != nil {
+			return err
+		}
+		if visibility == blob.Private && b.Owner == "" {
+			return forbidden("blob %s has no owner to keep it private for", id)
+		}
+	}
+	if _, ok := fields["acl"]; ok {
+		acl = req.ACL
+	}
+	if err := b.SetAccess(visibility, acl); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sizeLimitReader reads from r but fails with a 413 error as soon as more
+// than limit bytes have been read.
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.n > l.limit {
+		return 0, errTooLarge(l.limit)
+	}
+	if int64(len(p)) > l.limit-l.n+1 {
+		p = p[:l.limit-l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, errTooLarge(l.limit)
+	}
+	return n, err
+}
+
+func errTooLarge(limit int64) error {
+	size := fmt.Sprintf("%d bytes", limit)
+	if limit%MB == 0 {
+		size = fmt.Sprintf("%dMB", limit/MB)
+	}
+	return &statusError{http.StatusRequestEntityTooLarge, fmt.Errorf("blob exceeds max size of %s", size)}
+}
+
+// uploadOptions are applied to the blobs of an upload request
+type uploadOptions struct {
+	expiresAt    *time.Time // Expiry from the X-Expires-At/X-TTL headers or expires_at/ttl fields
+	visibility   string     // Visibility from the X-Visibility header or visibility field
+	stripEXIF    bool       // Strip JPEG metadata, from --strip-exif, the X-Strip-EXIF header or strip_exif field
+	exifMeta     bool       // Store the EXIF fields of stripped JPEGs in Meta, from the X-EXIF-Meta header or exif_meta field
+	keepOriginal bool       // Keep stripped JPEGs as a private blob, from the X-Keep-Original header or keep_original field
+	originals    bool       // Whether the token grants keeping originals
+	maxSize      int64      // Size limit in bytes, 0 for no limit
+	types        []string   // Content types the token allows, nil for any
+	owner        string     // Subject of the token, recorded as the blob owner
+}
+
+// set changes the option of a form field preceding the files it applies to.
+// Empty values clear the option.
+func (o *uploadOptions) set(name, value string) (err error) {
+	switch name {
+	case "expires_at":
+		o.expiresAt, err = parseExpiry(value, "")
+	case "ttl":
+		o.expiresAt, err = parseExpiry("", value)
+	case "visibility":
+		o.visibility, err = parseVisibility(value)
+	case "strip_exif":
+		o.stripEXIF, err = parseBool(name, value, *serverStripEXIF)
+	case "exif_meta":
+		o.exifMeta, err = parseBool(name, value, false)
+	case "keep_original":
+		o.keepOriginal, err = parseBool(name, value, false)
+	}
+	return err
+}
+
+// parseBool parses the value of a boolean option, which is def if empty
+func parseBool(name, value string, def bool) (bool, error) {
+	if value == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return v, nil
+}
+
+// parseVisibility validates a blob visibility
+func parseVisibility(v string) (string, error) {
+	switch v {
+	case "", blob.Public, blob.Private:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid visibility %q", v)
+}
+
+// uploadContentType decides the content-type of an upload from the claimed
+// type and the type sniffed from its data. Claims that conflict with the data
+// are rejected with --reject-mismatch, otherwise the sniffed type is used so
+// data is never served as something it is not. A conflicting claim never
+// makes the data scriptable, plain text is used instead.
+func uploadContentType(claimed, detected string) (string, error) {
+	switch {
+	case claimed == "":
+		return detected, nil
+	case !blob.TypesConflict(claimed, detected):
+		return claimed, nil
+	case *serverRejectMismatch:
+		return "", &statusError{http.StatusUnsupportedMediaType, fmt.Errorf("content is %s not %s", detected, claimed)}
+	case blob.Scriptable(detected):
+		return "text/plain; charset=utf-8", nil
+	}
+	return detected, nil
+}
+
+// Copy multipart file part to Blob
+func upload(part *multipart.Part, opts *uploadOptions) (b *blob.Blob, err error) {
+	if opts.keepOriginal && !opts.originals {
+		return nil, forbidden("token does not grant keeping originals")
+	}
+	// Originals are only private to their owner, so without one they
+	// would be readable by anyone
+	if opts.keepOriginal && opts.owner == "" {
+		return nil, forbidden("keeping originals needs a token with a subject to own them")
+	}
+	// Only the owner and their ACL can read private blobs, so without an
+	// owner the blob would be served to anyone
+	if opts.visibility == blob.Private && opts.owner == "" {
+		return nil, forbidden("private blobs need a token with a subject to own them")
 	}
-	defer upload.Close()
 	// Create blob
 	b = blob.New()
+	b.ExpiresAt = opts.expiresAt
+	b.Visibility = opts.visibility
+	b.Owner = opts.owner
 	// Set filename from request
-	b.Name = f.Filename
-	// Set content-type from request
-	if ct := f.Header.Get("Content-Type"); ct != "" {
-		b.ContentType = ct
-	}
-	// Guess content-type from extension if missing
-	if b.ContentType == "" || b.ContentType == ApplicationOctetStream {
+	b.Name = part.FileName()
+	// Claimed content-type from request, or guessed from the extension
+	claimed := part.Header.Get("Content-Type")
+	if claimed == "" || claimed == ApplicationOctetStream {
+		claimed = ""
 		if ext := filepath.Ext(b.Name); ext != "" {
-			b.ContentType = mime.TypeByExtension(ext)
+			claimed = mime.TypeByExtension(ext)
 		}
 	}
-	if b.ContentType == "" {
-		b.ContentType = ApplicationOctetStream
+	// Expected checksums from request
+	b.SHA256, b.MD5, err = expectedChecksums(part.Header)
+	if err != nil {
+		return
+	}
+	// Enforce max size
+	var src io.Reader = part
+	if opts.maxSize > 0 {
+		src = &sizeLimitReader{r: part, limit: opts.maxSize}
+	}
+	// Sniff content-type from the leading bytes
+	head := bufio.NewReaderSize(src, blob.SniffLen)
+	data, perr := head.Peek(blob.SniffLen)
+	if perr != nil && perr != io.EOF {
+		return nil, perr
+	}
+	detected := blob.Sniff(data)
+	if b.ContentType, err = uploadContentType(claimed, detected); err != nil {
+		return
+	}
+	b.Meta = map[string]string{"detected_type": detected}
+	if claimed != "" {
+		b.Meta["claimed_type"] = claimed
+	}
+	if !allowsType(opts.types, b.ContentType) {
+		return nil, forbidden("token does not allow uploading %s", b.ContentType)
+	}
+	if len(*serverAllowTypes) > 0 && !allowsType(*serverAllowTypes, b.ContentType) {
+		return nil, &statusError{http.StatusUnsupportedMediaType, fmt.Errorf("uploads of %s are not allowed", b.ContentType)}
+	}
+	// Strip metadata from JPEGs
+	var content io.Reader = head
+	var original *blob.Blob
+	if opts.stripEXIF && detected == "image/jpeg" {
+		if content, original, err = stripEXIF(b, head, opts); err != nil {
+			return
+		}
 	}
 	// Write
-	err = b.WriteFrom(upload)
+	err = b.WriteFrom(content)
 	if err != nil {
+		if original != nil {
+			original.Delete()
+		}
 		return
 	}
+	// Detect metadata, which is best effort
+	if err := b.DetectMeta(); err != nil {
+		fmt.Println("detecting metadata of blob", b.ID, "failed:", err)
+	}
 	return
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) error {
-	// Auth
-	if _, err := authenticate(r); err != nil {
+func uploadHandler(w http.ResponseWriter, r *http.Request) (err error) {
+	// Auth by token or signed upload URL
+	var c *claims
+	var spend func() error
+	if isSigned(r) {
+		c, spend, err = signedUploadClaims(r)
+	} else {
+		c, err = authorize(r, scopeWrite, uuid.UUID{})
+	}
+	if err != nil {
 		return err
 	}
 	// Parse
-	if err := r.ParseMultipartForm(*serverMaxUploadMem * MB); err != nil {
+	mr, err := r.MultipartReader()
+	if err != nil {
 		return err
 	}
-	form := r.MultipartForm
-	defer form.RemoveAll()
-	// For each file
-	uploads := form.File["file"]
+	// Options from headers, which can be changed by form fields
+	opts := &uploadOptions{maxSize: *serverMaxBlobSize * MB, types: c.Types, owner: c.Subject, originals: c.hasScope(scopeOriginal)}
+	if c.MaxSize > 0 && (opts.maxSize == 0 || c.MaxSize < opts.maxSize) {
+		opts.maxSize = c.MaxSize
+	}
+	if opts.expiresAt, err = parseExpiry(r.Header.Get("X-Expires-At"), r.Header.Get("X-TTL")); err != nil {
+		return err
+	}
+	if opts.visibility, err = parseVisibility(r.Header.Get("X-Visibility")); err != nil {
+		return err
+	}
+	if opts.stripEXIF, err = parseBool("X-Strip-EXIF", r.Header.Get("X-Strip-EXIF"), *serverStripEXIF); err != nil {
+		return err
+	}
+	if opts.exifMeta, err = parseBool("X-EXIF-Meta", r.Header.Get("X-EXIF-Meta"), false); err != nil {
+		return err
+	}
+	if opts.keepOriginal, err = parseBool("X-Keep-Original", r.Header.Get("X-Keep-Original"), false); err != nil {
+		return err
+	}
+	// Remove everything stored by a failed request
 	blobs := []*blob.Blob{}
-	for _, f := range uploads {
-		b, err := upload(f)
+	defer func() {
+		if err != nil {
+			for _, b := range blobs {
+				deleteBlob(b)
+			}
+		}
+	}()
+	// For each file
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if part.FileName() == "" {
+			// Option fields apply to the files that follow
+			value, err := ioutil.ReadAll(io.LimitReader(part, 64))
+			part.Close()
+			if err != nil {
+				return err
+			}
+			if err := opts.set(part.FormName(), string(value)); err != nil {
+				return err
+			}
+			continue
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		if spend != nil && len(blobs) > 0 {
+			part.Close()
+			return forbidden("signed upload URLs allow a single file")
+		}
+		b, err := upload(part, opts)
+		part.Close()
 		if err != nil {
 			return err
 		}
@@ -139,6 +668,14 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) error {
 	if len(blobs) == 0 {
 		return errors.New("no blobs stored")
 	}
+	if spend != nil {
+		if err := spend(); err != nil {
+			return err
+		}
+	}
+	for _, b := range blobs {
+		queueRender(b)
+	}
 	// Write JSON response
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(blobs); err != nil {
@@ -153,6 +690,9 @@ func ListenAndServe(addr string) error {
 	mux := http.NewServeMux()
 	mux.Handle("/test/", http.StripPrefix("/test/", http.FileServer(http.Dir("public"))))
 	mux.Handle("/favicon.ico", http.FileServer(http.Dir("public")))
+	mux.HandleFunc("/admin/dedup", DedupHandler)
+	mux.HandleFunc("/admin/scrub", ScrubHandler)
+	mux.HandleFunc("/sign", SignHandler)
 	mux.HandleFunc("/", BlobHandler)
 	return http.ListenAndServe(addr, mux)
 }
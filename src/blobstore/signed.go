@@ -0,0 +1,241 @@
+package main
+
+import (
+	"blob"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"uuid"
+)
+
+// Longest time a signed URL can be valid for
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// signature returns the HMAC of a request for method and path with params,
+// which must not include the sig param
+func signature(method, path string, params url.Values) string {
+	mac := hmac.New(sha256.New, []byte(*secretKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, path, params.Encode())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns the path and query of a URL that allows a method request
+// for path with params until expires
+func signURL(method, path string, params url.Values, expires time.Time) (string, error) {
+	if *secretKey == "" {
+		return "", errors.New("signed URLs require a secret key")
+	}
+	params.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	params.Set("sig", signature(method, path, params))
+	return path + "?" + params.Encode(), nil
+}
+
+// isSigned reports whether the request carries a URL signature
+func isSigned(r *http.Request) bool {
+	return r.URL.Query().Get("sig") != ""
+}
+
+// verifySignedURL checks the signature and expiry of a signed request and
+// returns the signed params. HEAD requests are allowed by GET signatures.
+func verifySignedURL(r *http.Request) (url.Values, time.Time, error) {
+	if *secretKey == "" {
+		return nil, time.Time{}, forbidden("signed URLs are not enabled")
+	}
+	params := r.URL.Query()
+	sig := params.Get("sig")
+	params.Del("sig")
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	expected := signature(method, r.URL.Path, params)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, time.Time{}, forbidden("invalid signature")
+	}
+	exp, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, time.Time{}, forbidden("invalid expires")
+	}
+	expires := time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return nil, time.Time{}, forbidden("signed URL expired")
+	}
+	return params, expires, nil
+}
+
+// spentUploads holds the nonces of signed upload URLs that have been used
+// until they expire, so each URL allows a single upload. They are only kept
+// in memory, so a URL can be used again after a restart.
+var spentUploads = struct {
+	sync.Mutex
+	nonces map[string]time.Time
+}{nonces: map[string]time.Time{}}
+
+// uploadSpent reports whether nonce has been used
+func uploadSpent(nonce string) bool {
+	spentUploads.Lock()
+	defer spentUploads.Unlock()
+	_, ok := spentUploads.nonces[nonce]
+	return ok
+}
+
+// spendUpload records the use of nonce and reports whether it was unused
+func spendUpload(nonce string, expires time.Time) bool {
+	spentUploads.Lock()
+	defer spentUploads.Unlock()
+	now := time.Now()
+	for n, exp := range spentUploads.nonces {
+		if now.After(exp) {
+			delete(spentUploads.nonces, n)
+		}
+	}
+	if _, ok := spentUploads.nonces[nonce]; ok {
+		return false
+	}
+	spentUploads.nonces[nonce] = expires
+	return true
+}
+
+// signedUploadClaims verifies a signed upload request and returns claims
+// granting the upload within the constraints of the URL, on behalf of the
+// subject of the token that signed it. The URL is only used up by calling
+// spend once the upload has succeeded, so a rejected upload can be retried.
+func signedUploadClaims(r *http.Request) (c *claims, spend func() error, err error) {
+	params, expires, err := verifySignedURL(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := params.Get("nonce")
+	if nonce == "" {
+		return nil, nil, forbidden("invalid signed upload URL")
+	}
+	if uploadSpent(nonce) {
+		return nil, nil, forbidden("signed upload URL has already been used")
+	}
+	c = &claims{Subject: params.Get("sub"), Scopes: []string{scopeWrite}, Types: params["content_type"]}
+	if v := params.Get("max_size"); v != "" {
+		if c.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, nil, forbidden("invalid max_size")
+		}
+	}
+	spend = func() error {
+		// Concurrent uploads with the same URL can all get this far, but
+		// only one of them is kept
+		if !spendUpload(nonce, expires) {
+			return forbidden("signed upload URL has already been used")
+		}
+		return nil
+	}
+	return c, spend, nil
+}
+
+// randomNonce returns a random hex string
+func randomNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func SignHandler(w http.ResponseWriter, r *http.Request) {
+	if err := signHandler(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// signHandler responds with a URL signed for downloading the blob in the
+// blob param, or for a single upload if there is no blob param. An upload URL
+// allows one successful request storing one file, and is not used up by
+// requests that are rejected. Uploads can be constrained by max_size and
+// content_type params. The URL expires after the ttl param, an hour by
+// default, and never grants more than the token.
+func signHandler(w http.ResponseWriter, r *http.Request) error {
+	ttl := time.Hour
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid ttl: %v", err)
+		}
+	}
+	if ttl <= 0 || ttl > maxSignedURLTTL {
+		return fmt.Errorf("ttl must be between 0 and %s", maxSignedURLTTL)
+	}
+	expires := time.Now().Add(ttl)
+	var signed string
+	if v := r.FormValue("blob"); v != "" {
+		id, err := uuid.ParseUUID(v)
+		if err != nil {
+			return err
+		}
+		c, err := authorize(r, scopeRead, id)
+		if err != nil {
+			return err
+		}
+		b, err := blob.Get(id)
+		if err != nil {
+			return err
+		}
+		if b.Private() && !c.granted(b, readers(b)) {
+			return forbidden("token does not grant access to blob %s", id)
+		}
+		if signed, err = signURL("GET", "/"+id.String(), url.Values{}, expires); err != nil {
+			return err
+		}
+	} else {
+		c, err := authorize(r, scopeWrite, uuid.UUID{})
+		if err != nil {
+			return err
+		}
+		params := url.Values{}
+		maxSize := c.MaxSize
+		if v := r.FormValue("max_size"); v != "" {
+			if maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || maxSize < 0 {
+				return fmt.Errorf("invalid max_size %q", v)
+			}
+			if c.MaxSize > 0 && (maxSize == 0 || maxSize > c.MaxSize) {
+				return forbidden("token does not allow uploads over %d bytes", c.MaxSize)
+			}
+		}
+		if maxSize > 0 {
+			params.Set("max_size", strconv.FormatInt(maxSize, 10))
+		}
+		types := r.Form["content_type"]
+		if len(types) == 0 {
+			types = c.Types
+		}
+		for _, t := range types {
+			if !allowsType(c.Types, t) {
+				return forbidden("token does not allow uploading %s", t)
+			}
+		}
+		if types != nil {
+			params["content_type"] = types
+		}
+		if c.Subject != "" {
+			params.Set("sub", c.Subject)
+		}
+		nonce, err := randomNonce()
+		if err != nil {
+			return err
+		}
+		params.Set("nonce", nonce)
+		if signed, err = signURL("POST", "/", params, expires); err != nil {
+			return err
+		}
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        signed,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"blob"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// thumbnailParams are the query parameters of a download that ask for a
+// resized image instead of the blob data
+var thumbnailParams = []string{"w", "h", "fit", "fmt"}
+
+// wantsThumbnail reports whether the request asks for a resized image
+func wantsThumbnail(r *http.Request) bool {
+	q := r.URL.Query()
+	for _, p := range thumbnailParams {
+		if _, ok := q[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultThumbSizes are the sizes images may be resized to without
+// --thumbnail-size. Every size allowed is another variant that may be
+// cached for each image, so they are few.
+var defaultThumbSizes = []int{64, 128, 256, 512, 1024}
+
+// thumbnailSize parses the w or h parameter, which must be allowed by the
+// thumbnail flags
+func thumbnailSize(q url.Values, name string) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, v)
+	}
+	if n > *serverThumbMax {
+		return 0, fmt.Errorf("%s must be at most %d", name, *serverThumbMax)
+	}
+	sizes := *serverThumbSizes
+	if len(sizes) == 0 {
+		sizes = defaultThumbSizes
+	}
+	for _, size := range sizes {
+		if n == size {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be one of %v", name, sizes)
+}
+
+// parseThumbnail returns the thumbnail described by the query parameters
+func parseThumbnail(q url.Values) (*blob.Thumbnail, error) {
+	if *serverThumbMax <= 0 {
+		return nil, &statusError{http.StatusNotImplemented, fmt.Errorf("resizing images is disabled")}
+	}
+	t := &blob.Thumbnail{Fit: q.Get("fit"), Format: q.Get("fmt")}
+	var err error
+	if t.Width, err = thumbnailSize(q, "w"); err != nil {
+		return nil, err
+	}
+	if t.Height, err = thumbnailSize(q, "h"); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// thumbnailETag returns the strong entity tag for a thumbnail of the blob,
+// which only changes if the blob data or the thumbnail parameters do
+func thumbnailETag(b *blob.Blob, t *blob.Thumbnail) string {
+	return strings.TrimSuffix(etag(b), `"`) + "-" + t.Name() + `"`
+}
+
+// thumbnailHandler responds with a resized variant of an image blob, which
+// is cached alongside the blob after the first request
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) error {
+	b, err := readableBlob(r, blobPathMatcher)
+	if err != nil {
+		return err
+	}
+	t, err := parseThumbnail(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	return serveThumbnail(w, r, b, t, func() (blob.File, error) {
+		return b.Thumbnail(t)
+	})
+}
+
+// serveThumbnail responds with the thumbnail t of b read from the file
+// returned by open, which is only called if the response needs the data
+func serveThumbnail(w http.ResponseWriter, r *http.Request, b *blob.Blob, t *blob.Thumbnail, open func() (blob.File, error)) error {
+	if b.Expired() {
+		return blob.ErrExpired
+	}
+	if err := t.SetDefaults(b.ContentType); err == blob.ErrNotImage {
+		return &statusError{http.StatusUnsupportedMediaType, err}
+	} else if err != nil {
+		return err
+	}
+	// Conditional requests are answered without generating the thumbnail
+	tag := thumbnailETag(b, t)
+	h := w.Header()
+	h.Set("Content-Type", t.ContentType())
+	h.Set("ETag", tag)
+	if b.ExpiresAt != nil {
+		h.Set("Expires", b.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if !checkPreconditions(w, r, tag) {
+		return nil
+	}
+	f, err := open()
+	if err == blob.ErrNotImage {
+		return &statusError{http.StatusUnsupportedMediaType, err}
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	http.ServeContent(w, r, "", b.Time(), f)
+	return nil
+}
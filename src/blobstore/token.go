@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"uuid"
+)
+
+// tokenClaims returns the claims of the token described by the token flags
+func tokenClaims() (map[string]interface{}, error) {
+	claims := map[string]interface{}{}
+	if len(*tokenScopes) > 0 {
+		claims["scope"] = *tokenScopes
+	}
+	if len(*tokenTypes) > 0 {
+		claims["content_type"] = *tokenTypes
+	}
+	if *tokenMaxSize < 0 {
+		return nil, errors.New("--max-size must not be negative")
+	}
+	if *tokenMaxSize > 0 {
+		claims["max_size"] = *tokenMaxSize
+	}
+	if *tokenBlob != "" {
+		id, err := uuid.ParseUUID(*tokenBlob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --blob: %v", err)
+		}
+		claims["blob"] = id.String()
+	}
+	if *tokenSubject != "" {
+		claims["sub"] = *tokenSubject
+	}
+	if len(*tokenGroups) > 0 {
+		claims["groups"] = *tokenGroups
+	}
+	if *tokenIssuer != "" {
+		claims["iss"] = *tokenIssuer
+	}
+	if *tokenAudience != "" {
+		claims["aud"] = *tokenAudience
+	}
+	return claims, nil
+}
+
+// tokenCommand writes a token signed with the secret key to w
+func tokenCommand(w io.Writer) error {
+	if *secretKey == "" {
+		return errors.New("--secret is required to sign tokens")
+	}
+	if *tokenExpiry <= 0 {
+		return errors.New("--expiry must be positive")
+	}
+	claims, err := tokenClaims()
+	if err != nil {
+		return err
+	}
+	signed, err := jwtEncode(*secretKey, claims, int64(tokenExpiry.Seconds()))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, signed)
+	return err
+}
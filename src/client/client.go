@@ -0,0 +1,365 @@
+// Package client is a Go client for the blobstore HTTP API.
+package client
+
+import (
+	"blob"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"uuid"
+)
+
+// Errors mapped from HTTP response statuses. Errors returned by the Client
+// for unsuccessful responses are of type *Error and wrap one of these when
+// the status is known.
+var (
+	ErrBadRequest      = errors.New("bad request")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrNotFound        = errors.New("blob not found")
+	ErrTooLarge        = errors.New("blob too large")
+	ErrGone            = errors.New("blob expired")
+	ErrUnsupportedType = errors.New("unsupported content type")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusGone:                  ErrGone,
+	http.StatusUnsupportedMediaType:  ErrUnsupportedType,
+}
+
+// Error is returned when the server responds with an unsuccessful status
+type Error struct {
+	StatusCode int    // HTTP status code
+	Message    string // Error message from the response body
+	Err        error  // One of the Err* values, or nil for unmapped statuses
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("blobstore: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("blobstore: %d %s", e.StatusCode, e.Message)
+}
+
+// Unwrap returns the mapped Err* value so errors.Is can be used
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// TokenSource provides the token sent in the Authorization header
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenFunc adapts a function to a TokenSource
+type TokenFunc func() (string, error)
+
+// Token calls f()
+func (f TokenFunc) Token() (string, error) {
+	return f()
+}
+
+// StaticToken is a TokenSource that always returns the same token
+type StaticToken string
+
+// Token returns the token
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// Client talks to a blobstore server
+type Client struct {
+	Endpoint   string       // Base URL of the blobstore, eg http://blobstore.kiloe.net
+	Tokens     TokenSource  // Optional source of tokens for authenticated requests
+	HTTPClient *http.Client // Client used to make requests, defaults to http.DefaultClient
+}
+
+// New returns a *Client for the blobstore at endpoint
+func New(endpoint string) *Client {
+	return &Client{
+		Endpoint: endpoint,
+	}
+}
+
+// Upload is a named source of blob data to Put
+type Upload struct {
+	Name      string    // filename of the blob
+	Body      io.Reader // blob data
+	ExpiresAt time.Time // optional time after which the blob is deleted
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// newRequest returns a request for path at the endpoint with a token from
+// the TokenSource if set.
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(c.Endpoint, "/")+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.Tokens != nil {
+		token, err := c.Tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", token)
+	}
+	return req, nil
+}
+
+// do sends req and returns the response if the request was successful.
+// Unsuccessful responses are returned as an *Error.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, &Error{
+			StatusCode: res.StatusCode,
+			Message:    strings.TrimSpace(string(msg)),
+			Err:        statusErrors[res.StatusCode],
+		}
+	}
+	return res, nil
+}
+
+// Put uploads the data read from r as a blob named name
+func (c *Client) Put(ctx context.Context, name string, r io.Reader) (*blob.Blob, error) {
+	blobs, err := c.PutAll(ctx, Upload{Name: name, Body: r})
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) != 1 {
+		return nil, fmt.Errorf("blobstore: expected 1 blob in response got %d", len(blobs))
+	}
+	return blobs[0], nil
+}
+
+// PutAll uploads each of the uploads as a blob in a single request. The
+// request body is streamed from the readers so they are never held in memory.
+func (c *Client) PutAll(ctx context.Context, uploads ...Upload) ([]*blob.Blob, error) {
+	body, pw := io.Pipe()
+	defer body.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipart(mw, uploads))
+	}()
+	req, err := c.newRequest(ctx, "POST", "", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var blobs []*blob.Blob
+	if err := json.NewDecoder(res.Body).Decode(&blobs); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// writeMultipart writes each upload as a "file" part to mw, preceded by an
+// "expires_at" field whenever the expiry changes from the previous upload
+func writeMultipart(mw *multipart.Writer, uploads []Upload) error {
+	var expiresAt time.Time
+	for _, u := range uploads {
+		if !u.ExpiresAt.Equal(expiresAt) {
+			value := ""
+			if !u.ExpiresAt.IsZero() {
+				value = u.ExpiresAt.Format(time.RFC3339)
+			}
+			if err := mw.WriteField("expires_at", value); err != nil {
+				return err
+			}
+			expiresAt = u.ExpiresAt
+		}
+		part, err := mw.CreateFormFile("file", u.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, u.Body); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// Get returns a reader streaming the blob data.
+// Users must close the reader.
+func (c *Client) Get(ctx context.Context, id uuid.UUID) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, "GET", id.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Info returns the blob metadata
+func (c *Client) Info(ctx context.Context, id uuid.UUID) (*blob.Blob, error) {
+	req, err := c.newRequest(ctx, "GET", id.String()+".json", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b := &blob.Blob{}
+	if err := json.NewDecoder(res.Body).Decode(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Delete removes the blob
+func (c *Client) Delete(ctx context.Context, id uuid.UUID) error {
+	req, err := c.newRequest(ctx, "DELETE", id.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// SetAccess changes the visibility and ACL of a blob owned by the token
+// holder and returns the updated blob. A nil acl removes the ACL.
+func (c *Client) SetAccess(ctx context.Context, id uuid.UUID, visibility string, acl *blob.ACL) (*blob.Blob, error) {
+	body, err := json.Marshal(map[string]interface{}{"visibility": visibility, "acl": acl})
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "PATCH", id.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b := &blob.Blob{}
+	if err := json.NewDecoder(res.Body).Decode(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// List returns a page of blobs matching q and the cursor for the next page,
+// which is invalid when there are no more results. Pass the cursor as
+// q.After to fetch the next page.
+func (c *Client) List(ctx context.Context, q blob.Query) ([]*blob.Blob, uuid.UUID, error) {
+	req, err := c.newRequest(ctx, "GET", "?"+q.Values().Encode(), nil)
+	if err != nil {
+		return nil, uuid.UUID{}, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, uuid.UUID{}, err
+	}
+	defer res.Body.Close()
+	var page struct {
+		Blobs []*blob.Blob `json:"blobs"`
+		Next  string       `json:"next"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, uuid.UUID{}, err
+	}
+	var next uuid.UUID
+	if page.Next != "" {
+		if next, err = uuid.ParseUUID(page.Next); err != nil {
+			return nil, uuid.UUID{}, err
+		}
+	}
+	return page.Blobs, next, nil
+}
+
+// SignedURL is a pre-signed URL that grants access without a token
+type SignedURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UploadPolicy constrains the upload allowed by a signed upload URL
+type UploadPolicy struct {
+	MaxSize      int64    // Byte limit on each blob, 0 for the limit of the token
+	ContentTypes []string // Allowed content types or prefixes such as image/, nil for those of the token
+}
+
+// SignDownload returns a URL that allows downloading the blob until ttl
+// has passed, or the server default if ttl is 0
+func (c *Client) SignDownload(ctx context.Context, id uuid.UUID, ttl time.Duration) (*SignedURL, error) {
+	v := url.Values{"blob": {id.String()}}
+	return c.sign(ctx, v, ttl)
+}
+
+// SignUpload returns a URL that allows a single upload of one file within the
+// policy until ttl has passed, or the server default if ttl is 0
+func (c *Client) SignUpload(ctx context.Context, policy UploadPolicy, ttl time.Duration) (*SignedURL, error) {
+	v := url.Values{}
+	if policy.MaxSize > 0 {
+		v.Set("max_size", strconv.FormatInt(policy.MaxSize, 10))
+	}
+	for _, t := range policy.ContentTypes {
+		v.Add("content_type", t)
+	}
+	return c.sign(ctx, v, ttl)
+}
+
+// sign requests a signed URL for v and resolves it against the endpoint
+func (c *Client) sign(ctx context.Context, v url.Values, ttl time.Duration) (*SignedURL, error) {
+	if ttl > 0 {
+		v.Set("ttl", ttl.String())
+	}
+	req, err := c.newRequest(ctx, "GET", "sign?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	signed := &SignedURL{}
+	if err := json.NewDecoder(res.Body).Decode(signed); err != nil {
+		return nil, err
+	}
+	signed.URL = strings.TrimRight(c.Endpoint, "/") + signed.URL
+	return signed, nil
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"blob"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"uuid"
+)
+
+// fakeServer implements enough of the blobstore API on top of an in-memory
+// store to exercise the client.
+func fakeServer(token string) *httptest.Server {
+	store := blob.NewStore(blob.NewMemoryBackend())
+	store.SetIndex(blob.NewIndex())
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			mr, err := r.MultipartReader()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			blobs := []*blob.Blob{}
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if part.FileName() == "" {
+					continue // form fields
+				}
+				b := store.New()
+				b.Name = part.FileName()
+				if err := b.WriteFrom(part); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				blobs = append(blobs, b)
+			}
+			json.NewEncoder(w).Encode(blobs)
+			return
+		}
+		if r.URL.Path == "/" {
+			q, err := blob.ParseQuery(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			blobs, next, _ := store.List(q)
+			res := map[string]interface{}{"blobs": blobs}
+			if next.Valid() {
+				res["next"] = next.String()
+			}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		id, err := uuid.ParseUUID(strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := store.Get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			b.Delete()
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(path, ".json"):
+			json.NewEncoder(w).Encode(b)
+		default:
+			f, _ := b.File()
+			defer f.Close()
+			io.Copy(w, f)
+		}
+	}))
+}
+
+func TestClient(t *testing.T) {
+	srv := fakeServer("secret-token")
+	defer srv.Close()
+	c := New(srv.URL)
+	c.Tokens = StaticToken("secret-token")
+	ctx := context.Background()
+	data := []byte("hello world")
+	b, err := c.Put(ctx, "hello.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Valid() || b.Name != "hello.txt" || b.Size != int64(len(data)) {
+		t.Fatalf("unexpected blob returned: %+v", b)
+	}
+	info, err := c.Info(ctx, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != b.ID || info.Name != b.Name {
+		t.Fatalf("expected info to match uploaded blob\ngot: %+v", info)
+	}
+	r, err := c.Get(ctx, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("expected downloaded bytes to equal uploaded bytes")
+	}
+	if err := c.Delete(ctx, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Info(ctx, b.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound got: %v", err)
+	}
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected *Error with 404 status got: %#v", err)
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	srv := fakeServer("secret-token")
+	defer srv.Close()
+	c := New(srv.URL)
+	_, err := c.Put(context.Background(), "hello.txt", strings.NewReader("hello"))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized got: %v", err)
+	}
+}
+
+func TestClientStatusErrors(t *testing.T) {
+	for code, exp := range map[int]error{http.StatusGone: ErrGone, http.StatusUnsupportedMediaType: ErrUnsupportedType} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(code), code)
+		}))
+		_, err := New(srv.URL).Info(context.Background(), uuid.UUID{1})
+		srv.Close()
+		if !errors.Is(err, exp) {
+			t.Errorf("expected %v for %d got: %v", exp, code, err)
+		}
+	}
+}
+
+func TestClientList(t *testing.T) {
+	srv := fakeServer("")
+	defer srv.Close()
+	c := New(srv.URL)
+	ctx := context.Background()
+	names := []string{"a.txt", "b.txt", "c.txt"}
+	for _, name := range names {
+		if _, err := c.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := []string{}
+	q := blob.Query{Limit: 2}
+	for {
+		blobs, next, err := c.List(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blobs {
+			seen = append(seen, b.Name)
+		}
+		if !next.Valid() {
+			break
+		}
+		q.After = next
+	}
+	if strings.Join(seen, ",") != strings.Join(names, ",") {
+		t.Fatalf("expected to list %v got: %v", names, seen)
+	}
+}